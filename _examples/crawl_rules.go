@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhshch2002/goribot"
+)
+
+func main() {
+	s := goribot.NewSpider(
+		goribot.Rules(
+			&goribot.LinkRule{ // links of repositories are handled but not followed
+				Extractor: &goribot.LinkExtractor{
+					Allow:       []string{`^https://github\.com/[\w-]+/[\w.-]+$`},
+					RestrictCSS: []string{"article"},
+				},
+				Handlers: []goribot.CtxHandlerFun{func(ctx *goribot.Context) {
+					fmt.Println(ctx.Resp.Dom.Find("title").Text())
+				}},
+			},
+			&goribot.LinkRule{ // follow the pages of trending
+				Extractor: &goribot.LinkExtractor{AllowGlobs: []string{"https://github.com/trending/*"}},
+				Follow:    true,
+			},
+		),
+		goribot.ReqDeduplicate(),
+		goribot.Limiter(true, &goribot.LimitRule{Glob: "github.com", MaxReq: 50}),
+	)
+	s.AddTask(goribot.Get("https://github.com/trending"))
+	s.Run()
+}
@@ -14,9 +14,14 @@ type Context struct {
 	// Meta the request task created by NewTaskWithMeta func will have a k-y pair
 	Meta map[string]interface{}
 
+	// Handlers are all the handlers of the task, including the registered ones
 	Handlers []CtxHandlerFun
 
+	task  *Task
 	abort bool
+	// unfinished is set if the request failed and nobody took care of it like retrying,
+	// so TaskDoneScheduler keeps the task for the next run
+	unfinished bool
 }
 
 // Abort this context to break the handler chain and stop handling
@@ -42,3 +47,16 @@ func (c *Context) AddTask(request *Request, handlers ...CtxHandlerFun) {
 		c.tasks = append(c.tasks, t)
 	}
 }
+
+// AddTaskByName add a task with the names of handlers registered by Spider.RegisterHandler to new task list
+func (c *Context) AddTaskByName(request *Request, names ...string) {
+	c.tasks = append(c.tasks, NewTaskByName(request, names...))
+}
+
+// copyTask creates a task of request with the same handlers as the task being handled
+func (c *Context) copyTask(request *Request) *Task {
+	if c.task == nil {
+		return NewTask(request, c.Handlers...)
+	}
+	return &Task{Request: request, Handlers: c.task.Handlers, HandlerNames: c.task.HandlerNames}
+}
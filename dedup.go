@@ -0,0 +1,602 @@
+package goribot
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrBadDeduplicatorData = errors.New("bad deduplicator data")
+
+// Deduplicator remembers the hashes of requests for deduplicating
+type Deduplicator interface {
+	// Seen reports whether the hash has been seen before, and marks it as seen
+	Seen(h [md5.Size]byte) bool
+}
+
+// Deduplicate is an extension drops the new tasks whose request hash by Spider.Fingerprinter has been seen by d.
+// The retried and periodic tasks are never dropped.
+func Deduplicate(d Deduplicator) func(s *Spider) {
+	return func(s *Spider) {
+		s.OnAdd(func(ctx *Context, t *Task) *Task {
+			if skipDeduplicate(t.Request) {
+				return t
+			}
+			if d.Seen(s.Fingerprinter.Fingerprint(t.Request)) {
+				s.stats.deduplicate()
+				return nil
+			}
+			return t
+		})
+	}
+}
+
+// PersistDeduplicator is an extension loads d from file at path if it exists, and saves d to it when spider finished.
+// d must be an io.WriterTo and io.ReaderFrom like MemoryDeduplicator and BloomDeduplicator.
+func PersistDeduplicator(d Deduplicator, path string) func(s *Spider) {
+	w, ok1 := d.(io.WriterTo)
+	r, ok2 := d.(io.ReaderFrom)
+	if !ok1 || !ok2 {
+		panic("deduplicator could not be persisted")
+	}
+	if f, err := os.Open(path); err == nil {
+		_, err = r.ReadFrom(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+	return func(s *Spider) {
+		s.OnFinish(func(s *Spider) {
+			if err := writeFileAtomic(path, w); err != nil {
+				Log.Error("save deduplicator error", err)
+			}
+		})
+	}
+}
+
+// writeFileAtomic writes a temporary file and renames it to path
+func writeFileAtomic(path string, w io.WriterTo) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	_, err = w.WriteTo(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countReader counts the bytes read
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// MemoryDeduplicator is an exact Deduplicator keeps hashes in memory.
+// The hashes expire after TTL if it's positive.
+type MemoryDeduplicator struct {
+	TTL       time.Duration
+	lock      sync.Mutex
+	seen      map[[md5.Size]byte]time.Time
+	lastClean time.Time
+}
+
+func NewMemoryDeduplicator(ttl time.Duration) *MemoryDeduplicator {
+	return &MemoryDeduplicator{TTL: ttl, seen: map[[md5.Size]byte]time.Time{}, lastClean: time.Now()}
+}
+
+func (d *MemoryDeduplicator) Seen(h [md5.Size]byte) bool {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.TTL > 0 && now.Sub(d.lastClean) >= d.TTL {
+		for k, at := range d.seen {
+			if now.Sub(at) >= d.TTL {
+				delete(d.seen, k)
+			}
+		}
+		d.lastClean = now
+	}
+	if at, ok := d.seen[h]; ok && (d.TTL <= 0 || now.Sub(at) < d.TTL) {
+		return true
+	}
+	d.seen[h] = now
+	return false
+}
+
+// Len returns the count of remembered hashes
+func (d *MemoryDeduplicator) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.seen)
+}
+
+// WriteTo writes the hashes and their time to w
+func (d *MemoryDeduplicator) WriteTo(w io.Writer) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cw := &countWriter{w: w}
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(d.seen))); err != nil {
+		return cw.n, err
+	}
+	for h, at := range d.seen {
+		if _, err := cw.Write(h[:]); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.BigEndian, at.UnixNano()); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom adds the hashes written by WriteTo
+func (d *MemoryDeduplicator) ReadFrom(r io.Reader) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cr := &countReader{r: r}
+	var n uint64
+	if err := binary.Read(cr, binary.BigEndian, &n); err != nil {
+		return cr.n, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var h [md5.Size]byte
+		var at int64
+		if _, err := io.ReadFull(cr, h[:]); err != nil {
+			return cr.n, err
+		}
+		if err := binary.Read(cr, binary.BigEndian, &at); err != nil {
+			return cr.n, err
+		}
+		d.seen[h] = time.Unix(0, at)
+	}
+	return cr.n, nil
+}
+
+// bloomLocations returns the k bit locations of h in m bits by double hashing
+func bloomLocations(h [md5.Size]byte, k uint32, m uint64) []uint64 {
+	h1 := binary.LittleEndian.Uint64(h[:8])
+	h2 := binary.LittleEndian.Uint64(h[8:]) | 1
+	res := make([]uint64, k)
+	for i := uint32(0); i < k; i++ {
+		res[i] = (h1 + uint64(i)*h2) % m
+	}
+	return res
+}
+
+// bloomSize returns the bits and hash functions of a bloom filter for capacity and false positive rate
+func bloomSize(capacity uint64, fp float64) (m uint64, k uint32) {
+	m = uint64(math.Ceil(-float64(capacity) * math.Log(fp) / (math.Ln2 * math.Ln2)))
+	k = uint32(math.Ceil(-math.Log2(fp)))
+	if m < 64 {
+		m = 64
+	}
+	if k < 1 {
+		k = 1
+	}
+	return
+}
+
+type bloomFilter struct {
+	capacity, count, m uint64
+	k                  uint32
+	bits               []uint64
+}
+
+func newBloomFilter(capacity uint64, fp float64) *bloomFilter {
+	m, k := bloomSize(capacity, fp)
+	return &bloomFilter{capacity: capacity, m: m, k: k, bits: make([]uint64, (m+63)/64)}
+}
+
+func (f *bloomFilter) has(h [md5.Size]byte) bool {
+	for _, l := range bloomLocations(h, f.k, f.m) {
+		if f.bits[l/64]&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h [md5.Size]byte) {
+	for _, l := range bloomLocations(h, f.k, f.m) {
+		f.bits[l/64] |= 1 << (l % 64)
+	}
+	f.count += 1
+}
+
+// BloomDeduplicator is a scalable bloom filter Deduplicator uses much less memory than MemoryDeduplicator.
+// It may drop a few requests never seen with the false positive rate, but never lets a seen one pass.
+// A new larger filter with a tighter rate is added when the filters are full, so the total false positive rate
+// keeps under FalsePositive.
+type BloomDeduplicator struct {
+	// FalsePositive is the max false positive rate
+	FalsePositive float64
+	// InitialCapacity is the capacity of the first filter
+	InitialCapacity uint64
+	lock            sync.Mutex
+	filters         []*bloomFilter
+}
+
+const (
+	bloomGrowth     = 2
+	bloomTightening = 0.5
+)
+
+// NewBloomDeduplicator creates a BloomDeduplicator with the initial capacity and max false positive rate like 0.001
+func NewBloomDeduplicator(capacity uint64, fp float64) *BloomDeduplicator {
+	if capacity == 0 || fp <= 0 || fp >= 1 {
+		panic("bad capacity or false positive rate of bloom filter")
+	}
+	return &BloomDeduplicator{FalsePositive: fp, InitialCapacity: capacity}
+}
+
+func (d *BloomDeduplicator) Seen(h [md5.Size]byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, f := range d.filters {
+		if f.has(h) {
+			return true
+		}
+	}
+	n := len(d.filters)
+	if n == 0 || d.filters[n-1].count >= d.filters[n-1].capacity {
+		// the sum of rates of filters is fp*(1-r)*(1+r+r^2...) < fp
+		capacity := d.InitialCapacity * uint64(math.Pow(bloomGrowth, float64(n)))
+		fp := d.FalsePositive * (1 - bloomTightening) * math.Pow(bloomTightening, float64(n))
+		d.filters = append(d.filters, newBloomFilter(capacity, fp))
+	}
+	d.filters[len(d.filters)-1].add(h)
+	return false
+}
+
+// Len returns the count of added hashes
+func (d *BloomDeduplicator) Len() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var n uint64
+	for _, f := range d.filters {
+		n += f.count
+	}
+	return n
+}
+
+// WriteTo writes the filters to w
+func (d *BloomDeduplicator) WriteTo(w io.Writer) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cw := &countWriter{w: w}
+	if err := binary.Write(cw, binary.BigEndian, uint32(len(d.filters))); err != nil {
+		return cw.n, err
+	}
+	for _, f := range d.filters {
+		for _, v := range []interface{}{f.capacity, f.count, f.m, f.k, f.bits} {
+			if err := binary.Write(cw, binary.BigEndian, v); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom replaces the filters with the ones written by WriteTo
+func (d *BloomDeduplicator) ReadFrom(r io.Reader) (int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cr := &countReader{r: r}
+	var n uint32
+	if err := binary.Read(cr, binary.BigEndian, &n); err != nil {
+		return cr.n, err
+	}
+	filters := make([]*bloomFilter, 0, n)
+	for i := uint32(0); i < n; i++ {
+		f := &bloomFilter{}
+		for _, v := range []interface{}{&f.capacity, &f.count, &f.m, &f.k} {
+			if err := binary.Read(cr, binary.BigEndian, v); err != nil {
+				return cr.n, err
+			}
+		}
+		if f.m == 0 || f.k == 0 || f.m > 1<<40 {
+			return cr.n, ErrBadDeduplicatorData
+		}
+		f.bits = make([]uint64, (f.m+63)/64)
+		if err := binary.Read(cr, binary.BigEndian, f.bits); err != nil {
+			return cr.n, err
+		}
+		filters = append(filters, f)
+	}
+	d.filters = filters
+	return cr.n, nil
+}
+
+// DiskDeduplicator is an exact Deduplicator keeps hashes in an open addressing hash table file,
+// so it uses little memory and it's persistent between runs. The file doubles when it's half full.
+type DiskDeduplicator struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	capacity uint64
+	count    uint64
+	hasZero  bool
+}
+
+const (
+	diskDedupMagic      = "GRDD"
+	diskDedupHeaderSize = 24
+	diskDedupMinSize    = 1 << 12
+)
+
+// NewDiskDeduplicator opens or creates the hash table file at path
+func NewDiskDeduplicator(path string) (*DiskDeduplicator, error) {
+	d := &DiskDeduplicator{path: path}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.file = f
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		err = d.init(f, diskDedupMinSize)
+	} else {
+		err = d.readHeader()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// init makes f an empty table with capacity
+func (d *DiskDeduplicator) init(f *os.File, capacity uint64) error {
+	d.file, d.capacity, d.count, d.hasZero = f, capacity, 0, false
+	if err := f.Truncate(diskDedupHeaderSize + int64(capacity)*md5.Size); err != nil {
+		return err
+	}
+	return d.writeHeader()
+}
+
+func (d *DiskDeduplicator) writeHeader() error {
+	var header [diskDedupHeaderSize]byte
+	copy(header[:], diskDedupMagic)
+	if d.hasZero {
+		header[4] = 1
+	}
+	binary.BigEndian.PutUint64(header[8:], d.capacity)
+	binary.BigEndian.PutUint64(header[16:], d.count)
+	_, err := d.file.WriteAt(header[:], 0)
+	return err
+}
+
+func (d *DiskDeduplicator) readHeader() error {
+	var header [diskDedupHeaderSize]byte
+	if _, err := d.file.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if string(header[:4]) != diskDedupMagic {
+		return ErrBadDeduplicatorData
+	}
+	d.hasZero = header[4] == 1
+	d.capacity = binary.BigEndian.Uint64(header[8:])
+	d.count = binary.BigEndian.Uint64(header[16:])
+	if d.capacity == 0 || d.capacity&(d.capacity-1) != 0 {
+		return ErrBadDeduplicatorData
+	}
+	return nil
+}
+
+// insert adds h to the table, returns true if it exists
+func (d *DiskDeduplicator) insert(h [md5.Size]byte) (bool, error) {
+	if h == [md5.Size]byte{} { // zero slot means empty
+		if d.hasZero {
+			return true, nil
+		}
+		d.hasZero = true
+		return false, d.writeHeader()
+	}
+	var slot [md5.Size]byte
+	i := binary.LittleEndian.Uint64(h[:8]) & (d.capacity - 1)
+	for {
+		off := diskDedupHeaderSize + int64(i)*md5.Size
+		if _, err := d.file.ReadAt(slot[:], off); err != nil {
+			return false, err
+		}
+		if slot == h {
+			return true, nil
+		}
+		if slot == [md5.Size]byte{} {
+			if _, err := d.file.WriteAt(h[:], off); err != nil {
+				return false, err
+			}
+			d.count += 1
+			return false, d.writeHeader()
+		}
+		i = (i + 1) & (d.capacity - 1)
+	}
+}
+
+// grow rehashes the table into a file with double capacity
+func (d *DiskDeduplicator) grow() error {
+	tmp, err := os.OpenFile(d.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	old := d.file
+	hasZero := d.hasZero
+	oldCapacity := d.capacity
+	err = func() error {
+		if err := d.init(tmp, oldCapacity*2); err != nil {
+			return err
+		}
+		d.hasZero = hasZero
+		r := bufio.NewReaderSize(io.NewSectionReader(old, diskDedupHeaderSize, int64(oldCapacity)*md5.Size), 1<<16)
+		var h [md5.Size]byte
+		for i := uint64(0); i < oldCapacity; i++ {
+			if _, err := io.ReadFull(r, h[:]); err != nil {
+				return err
+			}
+			if h != [md5.Size]byte{} {
+				if _, err := d.insert(h); err != nil {
+					return err
+				}
+			}
+		}
+		return d.writeHeader()
+	}()
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		d.file = old
+		if rerr := d.readHeader(); rerr != nil {
+			return fmt.Errorf("%v, and %v", err, rerr)
+		}
+		return err
+	}
+	return old.Close()
+}
+
+func (d *DiskDeduplicator) Seen(h [md5.Size]byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.file == nil {
+		Log.Error("seen hash in closed DiskDeduplicator")
+		return false
+	}
+	if (d.count+1)*2 > d.capacity {
+		if err := d.grow(); err != nil {
+			Log.Error("grow deduplicator file error", err)
+		}
+	}
+	seen, err := d.insert(h)
+	if err != nil {
+		Log.Error("deduplicator file error", err)
+	}
+	return seen
+}
+
+// Len returns the count of hashes
+func (d *DiskDeduplicator) Len() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.hasZero {
+		return d.count + 1
+	}
+	return d.count
+}
+
+// Close closes the file
+func (d *DiskDeduplicator) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// RedisSetDeduplicator is an exact Deduplicator keeps hashes in a redis set, it's shared by spiders
+type RedisSetDeduplicator struct {
+	redis *redis.Client
+	key   string
+}
+
+func NewRedisSetDeduplicator(r *redis.Client, key string) *RedisSetDeduplicator {
+	return &RedisSetDeduplicator{redis: r, key: key}
+}
+
+func (d *RedisSetDeduplicator) Seen(h [md5.Size]byte) bool {
+	res, err := d.redis.SAdd(d.key, h[:]).Result()
+	if err != nil {
+		Log.Error("redis deduplicate error", err)
+		return false
+	}
+	return res == 0
+}
+
+// RedisBloomDeduplicator is a bloom filter Deduplicator keeps bits in a redis bitmap, it's shared by spiders
+// and uses much less memory of redis than RedisSetDeduplicator.
+// Unlike BloomDeduplicator it doesn't grow, the false positive rate rises if more than capacity hashes are added.
+type RedisBloomDeduplicator struct {
+	redis *redis.Client
+	key   string
+	m     uint64
+	k     uint32
+}
+
+// NewRedisBloomDeduplicator creates a RedisBloomDeduplicator with capacity and false positive rate,
+// the bitmap is limited to 512MB by redis.
+func NewRedisBloomDeduplicator(r *redis.Client, key string, capacity uint64, fp float64) *RedisBloomDeduplicator {
+	if capacity == 0 || fp <= 0 || fp >= 1 {
+		panic("bad capacity or false positive rate of bloom filter")
+	}
+	m, k := bloomSize(capacity, fp)
+	if m > 1<<32 {
+		panic("bloom filter is larger than the max bitmap of redis")
+	}
+	return &RedisBloomDeduplicator{redis: r, key: key, m: m, k: k}
+}
+
+func (d *RedisBloomDeduplicator) Seen(h [md5.Size]byte) bool {
+	pipe := d.redis.TxPipeline()
+	var cmds []*redis.IntCmd
+	for _, l := range bloomLocations(h, d.k, d.m) {
+		cmds = append(cmds, pipe.SetBit(d.key, int64(l), 1))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		Log.Error("redis deduplicate error", err)
+		return false
+	}
+	for _, c := range cmds {
+		if c.Val() == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package goribot
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/go-redis/redis"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testHash(i int) [md5.Size]byte {
+	return md5.Sum([]byte(fmt.Sprint("http://example.com/", i)))
+}
+
+// checkDeduplicator adds n hashes twice, returns the false positives of the first time
+func checkDeduplicator(t *testing.T, d Deduplicator, n int) int {
+	fp := 0
+	for i := 0; i < n; i++ {
+		if d.Seen(testHash(i)) {
+			fp += 1
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !d.Seen(testHash(i)) {
+			t.Fatal("seen hash is lost", i)
+		}
+	}
+	return fp
+}
+
+func TestMemoryDeduplicator(t *testing.T) {
+	d := NewMemoryDeduplicator(0)
+	if checkDeduplicator(t, d, 1000) != 0 || d.Len() != 1000 {
+		t.Error("wrong memory deduplicator")
+	}
+
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup")
+	s := NewSpider(PersistDeduplicator(d, path))
+	s.Run()
+	d2 := NewMemoryDeduplicator(0)
+	PersistDeduplicator(d2, path)
+	if d2.Len() != 1000 || !d2.Seen(testHash(1)) || d2.Seen(testHash(1000)) {
+		t.Error("wrong loaded memory deduplicator")
+	}
+
+	ttl := NewMemoryDeduplicator(100 * time.Millisecond)
+	if ttl.Seen(testHash(0)) || !ttl.Seen(testHash(0)) {
+		t.Error("hash isn't deduplicated")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if ttl.Seen(testHash(0)) {
+		t.Error("hash isn't expired")
+	}
+}
+
+func TestBloomDeduplicator(t *testing.T) {
+	d := NewBloomDeduplicator(1000, 0.01)
+	fp := checkDeduplicator(t, d, 10000)
+	if fp > 100 {
+		t.Error("too many false positives", fp)
+	}
+	if len(d.filters) < 2 {
+		t.Error("bloom filter didn't scale", len(d.filters))
+	}
+	// a fresh set of hashes to measure the false positive rate
+	fp = 0
+	for i := 10000; i < 20000; i++ {
+		if d.Seen(testHash(i)) {
+			fp += 1
+		}
+	}
+	if fp > 100 {
+		t.Error("too many false positives", fp)
+	}
+
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bloom")
+	if err := writeFileAtomic(path, d); err != nil {
+		t.Fatal(err)
+	}
+	d2 := NewBloomDeduplicator(1000, 0.01)
+	PersistDeduplicator(d2, path)
+	if d2.Len() != d.Len() {
+		t.Error("wrong loaded bloom filter", d2.Len(), d.Len())
+	}
+	for i := 0; i < 20000; i++ {
+		if !d2.Seen(testHash(i)) {
+			t.Fatal("seen hash is lost after loading", i)
+		}
+	}
+}
+
+func TestDiskDeduplicator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup")
+
+	d, err := NewDiskDeduplicator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than the initial capacity to grow the file
+	if checkDeduplicator(t, d, 5000) != 0 || d.Len() != 5000 {
+		t.Error("wrong disk deduplicator")
+	}
+	if d.Seen([md5.Size]byte{}) || !d.Seen([md5.Size]byte{}) {
+		t.Error("wrong zero hash")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDiskDeduplicator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Len() != 5001 || !d.Seen(testHash(4999)) || !d.Seen([md5.Size]byte{}) || d.Seen(testHash(5000)) {
+		t.Error("wrong reopened disk deduplicator")
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	s := NewSpider(Deduplicate(NewBloomDeduplicator(100, 0.001)))
+	added := func(req *Request) bool {
+		return s.handleOnAdd(nil, NewTask(req)) != nil
+	}
+	if !added(Get("http://example.com/")) || added(Get("http://example.com/")) {
+		t.Error("request isn't deduplicated")
+	}
+	if !added(Get("http://example.com/").WithMeta("RetryTimes", 1)) {
+		t.Error("retried request is deduplicated")
+	}
+	if s.Stats().Deduplicated != 1 {
+		t.Error("wrong deduplicated requests", s.Stats().Deduplicated)
+	}
+}
+
+func TestRedisBloomDeduplicator(t *testing.T) {
+	if os.Getenv("DISABLE_SAVER_TEST") == "" {
+		return
+	}
+	r := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer r.Close()
+	r.Del("DedupTest_bloom")
+	defer r.Del("DedupTest_bloom")
+	d := NewRedisBloomDeduplicator(r, "DedupTest_bloom", 1000, 0.01)
+	if fp := checkDeduplicator(t, d, 1000); fp > 20 {
+		t.Error("too many false positives", fp)
+	}
+}
@@ -1,20 +1,17 @@
 package goribot
 
 import (
-	"crypto/md5"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/slyrz/robots"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime/debug"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -85,46 +82,13 @@ func SaveItemsAsCSV(f *os.File) func(s *Spider) {
 	}
 }
 
-// Retry is a extension make a new request when get response with error
+// Retry is a extension make a new request when get response with error or a status code not in okcode.
+// It's UseRetryPolicy with the backoff of NewRetryPolicy.
 func Retry(maxTimes int, okcode ...int) func(s *Spider) {
-	return func(s *Spider) {
-		s.OnError(func(ctx *Context, err error) {
-			if e, ok := err.(DownloaderErr); ok {
-				if e.Request != nil {
-					if t, ok := e.Request.Meta["RetryTimes"]; !ok || t.(int) < maxTimes {
-						req := e.Request
-						if !ok {
-							req.Meta["RetryTimes"] = 1
-						} else {
-							req.Meta["RetryTimes"] = req.Meta["RetryTimes"].(int) + 1
-						}
-						Log.Info("Request to", req.URL, "[tried", req.Meta["RetryTimes"], "times]", "got error.Retry.")
-						s.AddTask(req, ctx.Handlers...)
-					}
-				}
-			}
-		})
-		if len(okcode) > 0 {
-			s.OnResp(func(ctx *Context) {
-				for _, c := range okcode {
-					if ctx.Resp.StatusCode == c {
-						return
-					}
-					if t, ok := ctx.Req.Meta["RetryTimes"]; !ok || t.(int) < maxTimes {
-						req := ctx.Req
-						if !ok {
-							req.Meta["RetryTimes"] = 1
-						} else {
-							req.Meta["RetryTimes"] = req.Meta["RetryTimes"].(int) + 1
-						}
-						Log.Info("Request to", req.URL, "[tried", req.Meta["RetryTimes"], "times]", "got error.Retry.")
-						s.AddTask(req, ctx.Handlers...)
-						ctx.Abort()
-					}
-				}
-			})
-		}
-	}
+	p := NewRetryPolicy(maxTimes)
+	p.OkCodes = okcode
+	p.RetryCodes = nil
+	return UseRetryPolicy(p)
 }
 
 // RobotsTxt is an extension can parse the robots.txt and follow it
@@ -214,33 +178,34 @@ func SpiderLogError(f *os.File) func(s *Spider) {
 
 // SpiderLogPrint is a extension print spider working status
 func SpiderLogPrint() func(s *Spider) {
-	var t, i int64 = 0, 0
 	const n int64 = 5 // 打印时间间隔
-	go func() {
-		for {
-			tt, ii := atomic.LoadInt64(&t), atomic.LoadInt64(&i)
-			Log.Info(
-				"Handled", tt, "tasks and", ii, "items", "in", n, "sec",
-				tt/n, "task/sec", ii/n, "item/sec",
-			)
-			atomic.SwapInt64(&t, 0)
-			atomic.SwapInt64(&i, 0)
-			time.Sleep(time.Duration(n) * time.Second)
-		}
-	}()
 	return func(s *Spider) {
+		done := make(chan struct{})
 		s.OnStart(func(s *Spider) {
 			Log.Info("Spider start")
-		})
-		s.OnReq(func(ctx *Context, req *Request) *Request {
-			atomic.AddInt64(&t, 1)
-			return req
-		})
-		s.OnItem(func(item interface{}) interface{} {
-			atomic.AddInt64(&i, 1)
-			return item
+			go func() {
+				ticker := time.NewTicker(time.Duration(n) * time.Second)
+				defer ticker.Stop()
+				last := s.Stats()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+					}
+					st := s.Stats()
+					tt, ii := st.Requests-last.Requests, st.Items-last.Items
+					Log.Info(
+						"Handled", tt, "tasks and", ii, "items", "in", n, "sec",
+						tt/n, "task/sec", ii/n, "item/sec",
+						st.QueueDepth, "tasks queued", st.RunningTasks, "tasks running",
+					)
+					last = st
+				}
+			}()
 		})
 		s.OnFinish(func(s *Spider) {
+			close(done)
 			Log.Info("Spider finish")
 		})
 	}
@@ -268,6 +233,27 @@ func SetDepthFirst(d bool) func(s *Spider) {
 	}
 }
 
+// UsePriorityScheduler is an extension replaces BaseScheduler with PriorityScheduler
+func UsePriorityScheduler() func(s *Spider) {
+	return func(s *Spider) {
+		if _, ok := s.Scheduler.(*BaseScheduler); !ok {
+			panic("spider is not using BaseScheduler from goribot")
+		}
+		s.Scheduler = NewPriorityScheduler()
+	}
+}
+
+// UseHostScheduler is an extension replaces BaseScheduler with HostScheduler.
+// Use it before Limiter to skip the hosts waiting for Limiter.
+func UseHostScheduler() func(s *Spider) {
+	return func(s *Spider) {
+		if _, ok := s.Scheduler.(*BaseScheduler); !ok {
+			panic("spider is not using BaseScheduler from goribot")
+		}
+		s.Scheduler = NewHostScheduler()
+	}
+}
+
 // AddCookieToJar is an extension add a cookie to downloader's cookie jar
 func AddCookieToJar(urlAddr string, cookies ...*http.Cookie) func(s *Spider) {
 	return func(s *Spider) {
@@ -286,40 +272,27 @@ func AddCookieToJar(urlAddr string, cookies ...*http.Cookie) func(s *Spider) {
 
 // ReqDeduplicate is an extension can deduplicate new task
 func ReqDeduplicate() func(s *Spider) {
-	CrawledHash := map[[md5.Size]byte]struct{}{}
-	lock := sync.Mutex{}
-	return func(s *Spider) {
-		s.OnAdd(func(ctx *Context, t *Task) *Task {
-			if _, ok := t.Request.Meta["RetryTimes"]; ok {
-				return t
-			}
-			has := GetRequestHash(t.Request)
-
-			lock.Lock()
-			defer lock.Unlock()
-
-			if _, ok := CrawledHash[has]; ok {
-				return nil
-			}
+	return Deduplicate(NewMemoryDeduplicator(0))
+}
 
-			CrawledHash[has] = struct{}{}
-			return t
-		})
+// skipDeduplicate reports whether the request is a retried or periodic one which should be sent again
+func skipDeduplicate(req *Request) bool {
+	if _, ok := req.Meta["RetryTimes"]; ok {
+		return true
 	}
+	_, ok := req.Meta["Periodic"]
+	return ok
 }
 
 // RandomUserAgent is an extension can set random proxy url for new task
 func RandomProxy(p ...string) func(s *Spider) {
-	var RandSrc int64
+	ra := newLockedRand()
 	return func(s *Spider) {
 		s.OnReq(func(ctx *Context, req *Request) *Request {
 			_, ok := req.Meta["RandomProxy"]
 			if req.ProxyURL == "" || ok {
-				RandSrc += 1
-				ra := rand.New(rand.NewSource(time.Now().Unix() + RandSrc))
-				RandSrc = ra.Int63()
 				req.ProxyURL = p[ra.Intn(len(p))]
-				req.Meta["RandomProxy"] = struct{}{}
+				req.Meta["RandomProxy"] = true
 			}
 			return req
 		})
@@ -328,17 +301,13 @@ func RandomProxy(p ...string) func(s *Spider) {
 
 // RandomUserAgent is an extension can set random User-Agent for new task
 func RandomUserAgent() func(s *Spider) {
-	var RandSrc int64
+	ra := newLockedRand()
 	return func(s *Spider) {
 		s.OnReq(func(ctx *Context, req *Request) *Request {
 			_, ok := req.Meta["RandomUserAgent"]
 			if req.Request.Header.Get("User-Agent") == "" || ok {
-				RandSrc += 1
-				rs := rand.NewSource(time.Now().Unix() + RandSrc)
-				ra := rand.New(rs)
-				RandSrc = ra.Int63()
 				req.Request.Header.Set("User-Agent", uaList[ra.Intn(len(uaList))])
-				req.Meta["RandomUserAgent"] = struct{}{}
+				req.Meta["RandomUserAgent"] = true
 			}
 			return req
 		})
@@ -2,9 +2,12 @@ package goribot
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,16 +18,19 @@ func TestSavers(t *testing.T) {
 		cvsFile, _ = os.Open("/dev/null")
 		jsonFile, _ = os.Open("/dev/null")
 	} else {
-		var err error
-		cvsFile, err = os.Create("./test.cvs")
+		dir, err := ioutil.TempDir("", "goribot")
 		if err != nil {
 			panic(err)
 		}
-		jsonFile, err = os.Create("./test.json")
+		defer os.RemoveAll(dir)
+		cvsFile, err = os.Create(filepath.Join(dir, "test.cvs"))
+		if err != nil {
+			panic(err)
+		}
+		jsonFile, err = os.Create(filepath.Join(dir, "test.json"))
 		if err != nil {
 			panic(err)
 		}
-
 	}
 	defer cvsFile.Close()
 	defer jsonFile.Close()
@@ -75,18 +81,17 @@ func TestSpiderLogError(t *testing.T) {
 }
 
 func TestRetry(t *testing.T) {
-	ti := 0
+	var ti int64
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ti += 1
-		if ti < 3 {
+		if atomic.AddInt64(&ti, 1) < 3 {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		_, _ = fmt.Fprintf(w, "Hello goribot")
 	}))
 	defer ts.Close()
 
-	got := 0
+	var got int64
 	s := NewSpider(
 		Retry(3, http.StatusOK),
 	)
@@ -96,16 +101,16 @@ func TestRetry(t *testing.T) {
 		func(ctx *Context) {
 			Log.Info(ctx.Resp.Text, ctx.IsAborted())
 			if ctx.Resp.Text == "Hello goribot" {
-				got += 1
+				atomic.AddInt64(&got, 1)
 			}
 		},
 	)
 
 	s.Run()
-	if ti != 3 {
+	if atomic.LoadInt64(&ti) != 3 {
 		t.Error("Retry times wrong", ti)
 	}
-	if got != 1 {
+	if atomic.LoadInt64(&got) != 1 {
 		t.Error("wrong response", got)
 	}
 }
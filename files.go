@@ -0,0 +1,262 @@
+package goribot
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gobwas/glob"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FileLayout is how SaveFiles names the saved files
+type FileLayout uint8
+
+const (
+	// HashLayout names files by the sha256 of content like "ab/abcdef...png"
+	HashLayout FileLayout = iota
+	// URLPathLayout names files by the host and path of url like "example.com/images/a.png"
+	URLPathLayout
+)
+
+// FileRule selects the responses saved by SaveFiles.
+// A response is selected if its content type has a prefix in ContentTypes and its url matches Regexp or Glob,
+// the empty conditions are ignored.
+type FileRule struct {
+	// ContentTypes are the prefixes of content types like "image/" or "application/pdf"
+	ContentTypes   []string
+	Regexp, Glob   string
+	compiledRegexp *regexp.Regexp
+	compiledGlob   glob.Glob
+}
+
+func (r *FileRule) compile() {
+	if r.Glob != "" {
+		r.compiledGlob = glob.MustCompile(r.Glob)
+	}
+	if r.Regexp != "" {
+		r.compiledRegexp = regexp.MustCompile(r.Regexp)
+	}
+}
+
+// MatchURL reports whether the url matches the url patterns of rule
+func (r *FileRule) MatchURL(u *url.URL) bool {
+	if r.compiledGlob != nil && !r.compiledGlob.Match(u.String()) {
+		return false
+	}
+	if r.compiledRegexp != nil && !r.compiledRegexp.MatchString(u.String()) {
+		return false
+	}
+	return true
+}
+
+// Match reports whether the response with url and content type is selected by rule
+func (r *FileRule) Match(u *url.URL, contentType string) bool {
+	if len(r.ContentTypes) > 0 && !matchContentType(contentType, r.ContentTypes) {
+		return false
+	}
+	return r.MatchURL(u)
+}
+
+// FileItem is the item describes a file saved by SaveFiles
+type FileItem struct {
+	// Path is the path of file, it is in the dir passed to SaveFiles
+	Path string
+	Size int64
+	// SHA256 is the hex encoded sha256 checksum of file
+	SHA256      string
+	URL         string
+	ContentType string
+	// Duplicate is true if the same content was saved before and the file is not written again
+	Duplicate bool
+}
+
+// SaveFiles is an extension saves the bodies of responses selected by rules to files in dir,
+// and adds a FileItem for every response. It's also set to the response Meta with key "SavedFile".
+// The bodies are streamed to disk for the rules with only ContentTypes or a url pattern,
+// and the saved bodies are consumed before handlers.
+func SaveFiles(dir string, layout FileLayout, rules ...*FileRule) func(s *Spider) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	for _, r := range rules {
+		r.compile()
+	}
+	saved := &savedFiles{paths: map[string]string{}, hashes: map[string]string{}}
+	return func(s *Spider) {
+		if d, ok := s.Downloader.(*BaseDownloader); ok {
+			for _, r := range rules {
+				if r.Regexp == "" && r.Glob == "" {
+					d.StreamContentTypes = append(d.StreamContentTypes, r.ContentTypes...)
+				}
+			}
+		}
+		s.OnReq(func(ctx *Context, req *Request) *Request {
+			if req.Stream {
+				return req
+			}
+			for _, r := range rules {
+				if (r.Regexp != "" || r.Glob != "") && r.MatchURL(req.URL) {
+					req.Stream = true
+					req.Meta["SaveFilesStream"] = true
+					break
+				}
+			}
+			return req
+		})
+		s.OnResp(func(ctx *Context) {
+			resp := ctx.Resp
+			contentType := resp.Header.Get("Content-Type")
+			var rule *FileRule
+			for _, r := range rules {
+				if r.Match(resp.Req.URL, contentType) {
+					rule = r
+					break
+				}
+			}
+			if _, ok := resp.Req.Meta["SaveFilesStream"]; ok && rule == nil {
+				// it's streamed for saving, read it back for handlers
+				delete(resp.Req.Meta, "SaveFilesStream")
+				body, err := ioutil.ReadAll(resp.BodyReader)
+				_ = resp.CloseBody()
+				resp.BodyReader = nil
+				if err != nil {
+					s.handleOnError(ctx, DownloaderErr{err, resp.Req, resp})
+					ctx.Abort()
+					return
+				}
+				resp.Body, resp.RawBody = body, body
+				_ = resp.DecodeAndParse()
+				return
+			}
+			if rule == nil {
+				return
+			}
+			var body io.Reader = bytes.NewReader(resp.RawBody)
+			if resp.BodyReader != nil {
+				body = resp.BodyReader
+			}
+			item, err := saveFile(dir, layout, resp, body, saved)
+			if err != nil {
+				Log.Error("save file error", err)
+				s.handleOnError(ctx, DownloaderErr{err, resp.Req, resp})
+				return
+			}
+			resp.Meta["SavedFile"] = item
+			ctx.AddItem(item)
+		})
+	}
+}
+
+// savedFiles keeps the saved files for deduplicating
+type savedFiles struct {
+	lock   sync.Mutex
+	paths  map[string]string // sha256 to path
+	hashes map[string]string // path to sha256
+}
+
+// add records the file at path, the old file overwritten at path is forgotten
+func (s *savedFiles) add(sha, path string) {
+	if old, ok := s.hashes[path]; ok && old != sha {
+		delete(s.paths, old)
+	}
+	s.paths[sha] = path
+	s.hashes[path] = sha
+}
+
+// saveFile writes body to a temporary file and moves it to the path by layout
+func saveFile(dir string, layout FileLayout, resp *Response, body io.Reader, saved *savedFiles) (FileItem, error) {
+	item := FileItem{URL: resp.Req.URL.String(), ContentType: resp.Header.Get("Content-Type")}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return item, err
+	}
+	h := sha256.New()
+	item.Size, err = io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return item, err
+	}
+	item.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	var name string
+	if layout == URLPathLayout {
+		name = urlFilePath(resp.Req.URL, item.ContentType)
+	} else {
+		name = filepath.Join(item.SHA256[:2], item.SHA256+fileExt(resp.Req.URL, item.ContentType))
+	}
+	item.Path = filepath.Join(dir, name)
+
+	saved.lock.Lock()
+	defer saved.lock.Unlock()
+	if p, ok := saved.paths[item.SHA256]; ok {
+		item.Path, item.Duplicate = p, true
+	} else if _, err := os.Stat(item.Path); err == nil && layout == HashLayout {
+		item.Duplicate = true
+	}
+	if item.Duplicate {
+		saved.add(item.SHA256, item.Path)
+		return item, os.Remove(f.Name())
+	}
+	if err := os.MkdirAll(filepath.Dir(item.Path), 0755); err != nil {
+		os.Remove(f.Name())
+		return item, err
+	}
+	if err := os.Rename(f.Name(), item.Path); err != nil {
+		os.Remove(f.Name())
+		return item, err
+	}
+	saved.add(item.SHA256, item.Path)
+	return item, nil
+}
+
+// urlFilePath returns the path of file for url in URLPathLayout
+func urlFilePath(u *url.URL, contentType string) string {
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") || p == "/" {
+		p = path.Join(p, "index")
+	}
+	if u.RawQuery != "" {
+		h := md5.Sum([]byte(u.RawQuery))
+		ext := path.Ext(p)
+		p = strings.TrimSuffix(p, ext) + "-" + hex.EncodeToString(h[:4]) + ext
+	}
+	if path.Ext(p) == "" {
+		p += fileExt(u, contentType)
+	}
+	return filepath.Join(hostDirName(u.Host), filepath.FromSlash(p))
+}
+
+// hostDirName returns the host as a single directory name, so it couldn't point outside the dir of files
+func hostDirName(host string) string {
+	host = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(strings.ToLower(host))
+	if host == "" || host == "." || host == ".." {
+		host = "_" + host
+	}
+	return host
+}
+
+// fileExt returns the extension of file by the path of url or the content type
+func fileExt(u *url.URL, contentType string) string {
+	if ext := path.Ext(u.Path); ext != "" {
+		return ext
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			return exts[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package goribot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSaveFiles(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nfake image")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png", "/copy/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(png)
+		case "/download":
+			w.Header().Set("Content-Type", "application/pdf")
+			_, _ = w.Write([]byte("%PDF-1.4 fake"))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = fmt.Fprintf(w, "<html><body><p>Hello goribot</p></body></html>")
+		}
+	}))
+	defer ts.Close()
+	h := sha256.Sum256(png)
+	pngHash := hex.EncodeToString(h[:])
+
+	for _, layout := range []FileLayout{HashLayout, URLPathLayout} {
+		dir, err := ioutil.TempDir("", "goribot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		lock := sync.Mutex{}
+		items := map[string]FileItem{}
+		s := NewSpider(
+			SaveFiles(dir, layout,
+				&FileRule{ContentTypes: []string{"image/"}},
+				&FileRule{Glob: ts.URL + "/download*"},
+			),
+		)
+		s.OnItem(func(i interface{}) interface{} {
+			if f, ok := i.(FileItem); ok {
+				lock.Lock()
+				items[f.URL] = f
+				lock.Unlock()
+			}
+			return i
+		})
+		s.SetTaskPoolSize(1)
+		s.AddTask(GetReq(ts.URL+"/a.png"), func(ctx *Context) {
+			if _, ok := ctx.Meta["SavedFile"]; !ok {
+				t.Error("saved file isn't in meta")
+			}
+		})
+		s.AddTask(GetReq(ts.URL+"/copy/a.png"), func(ctx *Context) {})
+		s.AddTask(GetReq(ts.URL+"/download"), func(ctx *Context) {})
+		s.AddTask(GetReq(ts.URL+"/page"), func(ctx *Context) {
+			if ctx.Resp.Dom == nil || ctx.Resp.Dom.Find("p").Text() != "Hello goribot" {
+				t.Error("wrong response of page", ctx.Resp.Text)
+			}
+		})
+		s.Run()
+
+		if len(items) != 3 {
+			t.Fatal(layout, "wrong items", items)
+		}
+		a, copied, pdf := items[ts.URL+"/a.png"], items[ts.URL+"/copy/a.png"], items[ts.URL+"/download"]
+		if a.SHA256 != pngHash || a.Size != int64(len(png)) || a.Duplicate {
+			t.Error(layout, "wrong item", a)
+		}
+		if !copied.Duplicate || copied.Path != a.Path {
+			t.Error(layout, "duplicate file isn't detected", copied)
+		}
+		data, err := ioutil.ReadFile(a.Path)
+		if err != nil || string(data) != string(png) {
+			t.Error(layout, "wrong file", err, data)
+		}
+		if data, err := ioutil.ReadFile(pdf.Path); err != nil || string(data) != "%PDF-1.4 fake" {
+			t.Error(layout, "wrong file", err, data)
+		}
+		if layout == HashLayout && a.Path != filepath.Join(dir, pngHash[:2], pngHash+".png") {
+			t.Error("wrong path", a.Path)
+		}
+		if layout == URLPathLayout && filepath.Ext(pdf.Path) != ".pdf" {
+			t.Error("wrong path", pdf.Path)
+		}
+	}
+}
+
+func TestURLFilePath(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"http://Example.com:8080/a/b.pdf", "example.com_8080/a/b.pdf"},
+		{"http://example.com/../../etc/passwd.txt", "example.com/etc/passwd.txt"},
+		{"http://example.com/dir/", "example.com/dir/index"},
+		{"http://../x.txt", "_../x.txt"},
+		{"http://./x.txt", "_./x.txt"},
+		{"file:///x.txt", "_/x.txt"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := urlFilePath(u, ""); res != filepath.FromSlash(c.out) {
+			t.Errorf("urlFilePath(%q) = %q, want %q", c.in, res, c.out)
+		}
+	}
+}
+
+func TestSaveFileOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := &savedFiles{paths: map[string]string{}, hashes: map[string]string{}}
+	save := func(u, body string) FileItem {
+		resp := &Response{Response: &http.Response{Header: http.Header{"Content-Type": {"image/png"}}}, Req: Get(u)}
+		item, err := saveFile(dir, URLPathLayout, resp, strings.NewReader(body), saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	old := save("http://example.com/a.png", "old")
+	save("http://example.com/a.png", "new") // overwrites the old one
+	copied := save("http://example.com/copy/a.png", "old")
+	if copied.Duplicate || copied.Path == old.Path {
+		t.Error("overwritten file is reported as duplicate", copied)
+	}
+	if data, err := ioutil.ReadFile(copied.Path); err != nil || string(data) != "old" {
+		t.Error("wrong file", err, string(data))
+	}
+}
@@ -0,0 +1,124 @@
+package goribot
+
+import (
+	"crypto/md5"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Fingerprinter computes the hash of request used by deduplicating, the same requests should have the same hash
+type Fingerprinter interface {
+	Fingerprint(req *Request) [md5.Size]byte
+}
+
+// DefaultIgnoreParams are the tracking and session id params ignored by DefaultFingerprinter
+var DefaultIgnoreParams = []string{"utm_*", "fbclid", "gclid", "msclkid", "jsessionid", "phpsessid", "aspsessionid*", "sessionid"}
+
+// DefaultFingerprinter is the Fingerprinter of new spiders,
+// it hashes the method, url normalized by DefaultNormalizer and body of request but no header.
+var DefaultFingerprinter Fingerprinter = &RequestFingerprinter{
+	Normalizer: DefaultNormalizer,
+	Body:       true,
+}
+
+// RequestFingerprinter is a configurable Fingerprinter.
+// The url is canonicalized by URLNormalizer with sorted query params.
+type RequestFingerprinter struct {
+	// Normalizer normalizes the url before canonicalizing, like the per host rules of a URLNormalizer
+	Normalizer *URLNormalizer
+	// Headers are the names of headers included
+	Headers []string
+	// AllHeaders includes all the headers except ExcludeHeaders
+	AllHeaders bool
+	// ExcludeHeaders are the names of headers excluded when AllHeaders is true
+	ExcludeHeaders []string
+	// IgnoreParams are the case-insensitive patterns of query and path params ignored like "utm_*", see path.Match
+	IgnoreParams []string
+	// IgnoreTrailingSlash makes "/a/" the same as "/a"
+	IgnoreTrailingSlash bool
+	// KeepFragment includes the fragment of url
+	KeepFragment bool
+	// Body includes the body of request
+	Body bool
+}
+
+func (f *RequestFingerprinter) Fingerprint(req *Request) [md5.Size]byte {
+	h := md5.New()
+	write := func(s string) {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+	if req.Request == nil {
+		return [md5.Size]byte{}
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	write(method)
+	write(f.CanonicalURL(req.URL))
+	for _, k := range f.headerNames(req.Header) {
+		val := append([]string(nil), req.Header[k]...)
+		sort.Strings(val)
+		for _, v := range val {
+			write(k + ":" + v)
+		}
+	}
+	if f.Body {
+		write("")
+		_, _ = h.Write(req.GetBody())
+	}
+	var res [md5.Size]byte
+	copy(res[:], h.Sum(nil))
+	return res
+}
+
+// headerNames returns the sorted names of included headers
+func (f *RequestFingerprinter) headerNames(header http.Header) []string {
+	var res []string
+	if f.AllHeaders {
+		exclude := map[string]struct{}{}
+		for _, k := range f.ExcludeHeaders {
+			exclude[http.CanonicalHeaderKey(k)] = struct{}{}
+		}
+		for k := range header {
+			if _, ok := exclude[http.CanonicalHeaderKey(k)]; !ok {
+				res = append(res, k)
+			}
+		}
+	} else {
+		for _, k := range f.Headers {
+			if _, ok := header[http.CanonicalHeaderKey(k)]; ok {
+				res = append(res, http.CanonicalHeaderKey(k))
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// CanonicalURL returns the canonical form of u used by Fingerprint
+func (f *RequestFingerprinter) CanonicalURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if f.Normalizer != nil {
+		u = f.Normalizer.Normalize(u)
+	}
+	n := URLNormalizer{
+		RemoveParams:        f.IgnoreParams,
+		RemoveFragment:      !f.KeepFragment,
+		RemoveTrailingSlash: f.IgnoreTrailingSlash,
+		SortQuery:           true,
+	}
+	return n.Normalize(u).String()
+}
+
+// UseFingerprinter is an extension sets the Fingerprinter of spider used by deduplicate extensions
+func UseFingerprinter(f Fingerprinter) func(s *Spider) {
+	return func(s *Spider) {
+		s.Fingerprinter = f
+	}
+}
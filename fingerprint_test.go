@@ -0,0 +1,76 @@
+package goribot
+
+import (
+	"crypto/md5"
+	"net/http"
+	"testing"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	f := &RequestFingerprinter{IgnoreParams: DefaultIgnoreParams, IgnoreTrailingSlash: true}
+	cases := []struct{ in, out string }{
+		{"HTTP://Example.COM:80/a#frag", "http://example.com/a"},
+		{"https://example.com:443", "https://example.com/"},
+		{"https://example.com:8443/", "https://example.com:8443/"},
+		{"http://example.com/a/", "http://example.com/a"},
+		{"http://example.com/%7euser/%e4%bd%a0", "http://example.com/~user/%E4%BD%A0"},
+		{"http://example.com/?b=2&a=1&a=0", "http://example.com/?a=0&a=1&b=2"},
+		{"http://example.com/?q=a+b&r=a%20b", "http://example.com/?q=a+b&r=a+b"},
+		{"http://example.com/?utm_source=x&id=1&UTM_Medium=y&fbclid=z", "http://example.com/?id=1"},
+		{"http://example.com/a;jsessionid=123?PHPSESSID=abc", "http://example.com/a"},
+		{"http://[::1]:80/", "http://[::1]/"},
+	}
+	for _, c := range cases {
+		if res := f.CanonicalURL(Get(c.in).URL); res != c.out {
+			t.Errorf("CanonicalURL(%q) = %q, want %q", c.in, res, c.out)
+		}
+	}
+	if res := (&RequestFingerprinter{KeepFragment: true}).CanonicalURL(Get("http://example.com/a/#b").URL); res != "http://example.com/a/#b" {
+		t.Error("wrong url with fragment", res)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	f := DefaultFingerprinter
+	same := func(a, b *Request) bool {
+		return f.Fingerprint(a) == f.Fingerprint(b)
+	}
+	if !same(Get("http://example.com/?utm_source=a"), Get("http://EXAMPLE.com").SetHeader("User-Agent", "goribot").SetHeader("Referer", "http://example.com/")) {
+		t.Error("headers or tracking params change fingerprint")
+	}
+	if same(Get("http://example.com/"), PostRawReq("http://example.com/", []byte{})) {
+		t.Error("method doesn't change fingerprint")
+	}
+	if same(PostRawReq("http://example.com/", []byte("a")), PostRawReq("http://example.com/", []byte("b"))) {
+		t.Error("body doesn't change fingerprint")
+	}
+
+	f = &RequestFingerprinter{Headers: []string{"accept-language"}}
+	if same(Get("http://example.com/").SetHeader("Accept-Language", "en"), Get("http://example.com/").SetHeader("Accept-Language", "zh")) {
+		t.Error("included header doesn't change fingerprint")
+	}
+	f = &RequestFingerprinter{AllHeaders: true, ExcludeHeaders: []string{"user-agent"}}
+	if !same(Get("http://example.com/").SetHeader("User-Agent", "a"), Get("http://example.com/").SetHeader("User-Agent", "b")) {
+		t.Error("excluded header changes fingerprint")
+	}
+	if same(Get("http://example.com/").SetHeader("Accept", "a"), Get("http://example.com/")) {
+		t.Error("header doesn't change fingerprint")
+	}
+
+	s := NewSpider(RandomUserAgent(), RefererFiller(), ReqDeduplicate())
+	if s.handleOnAdd(nil, NewTask(Get("http://example.com/a?utm_source=x"))) == nil ||
+		s.handleOnAdd(nil, NewTask(Get("http://example.com/a").SetHeader("Referer", "http://example.com/"))) != nil {
+		t.Error("request isn't deduplicated by fingerprint")
+	}
+}
+
+func TestGetRequestHash(t *testing.T) {
+	req := PostRawReq("HTTP://Example.com/a?b=2&a=1", []byte("body"))
+	req.Header = http.Header{"User-Agent": {"goribot"}}
+	req.AddCookie(&http.Cookie{Name: "k", Value: "v"})
+	// the same as the old versions
+	want := md5.Sum([]byte("http://example.com/a?a=1&b=2@#@Cookie=k%3Dv&User-Agent=goribot@#@k=v"))
+	if GetRequestHash(req) != want {
+		t.Error("GetRequestHash is changed")
+	}
+}
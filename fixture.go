@@ -0,0 +1,178 @@
+package goribot
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrNoFixture = errors.New("no fixture recorded for request")
+
+// Fixture is a recorded pair of request and response.
+// Fixtures of the same request are saved in one json file in order.
+type Fixture struct {
+	Method      string
+	URL         string
+	RequestBody string `json:",omitempty"`
+	StatusCode  int
+	Header      http.Header
+	// Body is the raw content of the response, it's base64 encoded if BodyBase64 is true
+	Body       string
+	BodyBase64 bool `json:",omitempty"`
+}
+
+func newFixture(req *Request, reqBody []byte, resp *Response) *Fixture {
+	f := &Fixture{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		RequestBody: string(reqBody),
+		StatusCode:  resp.StatusCode,
+		Header:      resp.Header.Clone(),
+	}
+	if utf8.Valid(resp.RawBody) {
+		f.Body = string(resp.RawBody)
+	} else {
+		f.Body = base64.StdEncoding.EncodeToString(resp.RawBody)
+		f.BodyBase64 = true
+	}
+	return f
+}
+
+func (f *Fixture) response(req *Request) (*Response, error) {
+	body := []byte(f.Body)
+	if f.BodyBase64 {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(f.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newResponse(req, f.StatusCode, f.Header, body), nil
+}
+
+// fixturePath returns the file of fixtures of request in dir
+func fixturePath(dir string, req *Request) string {
+	h := md5.Sum([]byte(cacheKey(req)))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// RecordFixtures is an extension records every response to fixture files in dir,
+// so the spider could run offline with ReplayFixtures later.
+// The fixtures recorded before in dir will be overwritten.
+func RecordFixtures(dir string) func(s *Spider) {
+	return func(s *Spider) {
+		s.Downloader.AddMiddleware(FixtureRecorder(dir))
+	}
+}
+
+// FixtureRecorder returns the Downloader middleware used by RecordFixtures
+func FixtureRecorder(dir string) func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	lock := sync.Mutex{}
+	recorded := map[string][]*Fixture{}
+	return func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+		if req.Err != nil {
+			return next(req)
+		}
+		// the body of request is consumed after sending
+		path, reqBody := fixturePath(dir, req), req.GetBody()
+		resp, err = next(req)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		if resp.BodyReader != nil { // read the stream to record it
+			body, err := ioutil.ReadAll(resp.BodyReader)
+			_ = resp.CloseBody()
+			if err != nil {
+				return nil, DownloaderErr{err, req, resp}
+			}
+			resp.RawBody = body
+			resp.BodyReader = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		f := newFixture(req, reqBody, resp)
+		if resp.BodyReader != nil {
+			resp.RawBody = nil
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		recorded[path] = append(recorded[path], f)
+		data, err := json.MarshalIndent(recorded[path], "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			Log.Error("record fixture error", err)
+		}
+		return resp, nil
+	}
+}
+
+// ReplayFixtures is an extension serves responses from the fixture files recorded by RecordFixtures
+// without network. The responses recorded for the same request are served in order and the last one
+// is repeated. Requests without fixture fail with ErrNoFixture.
+func ReplayFixtures(dir string) func(s *Spider) {
+	return func(s *Spider) {
+		s.Downloader.AddMiddleware(FixtureReplayer(dir))
+	}
+}
+
+// FixtureReplayer returns the Downloader middleware used by ReplayFixtures
+func FixtureReplayer(dir string) func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+	lock := sync.Mutex{}
+	fixtures := map[string][]*Fixture{}
+	served := map[string]int{}
+	return func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+		if req.Err != nil {
+			return nil, DownloaderErr{req.Err, req, nil}
+		}
+		path := fixturePath(dir, req)
+
+		lock.Lock()
+		fs, ok := fixtures[path]
+		if !ok {
+			data, err := ioutil.ReadFile(path)
+			if err == nil {
+				err = json.Unmarshal(data, &fs)
+			}
+			if err != nil && !os.IsNotExist(err) {
+				lock.Unlock()
+				return nil, DownloaderErr{err, req, nil}
+			}
+			fixtures[path] = fs
+		}
+		var f *Fixture
+		if len(fs) > 0 {
+			i := served[path]
+			if i >= len(fs) {
+				i = len(fs) - 1
+			}
+			served[path] += 1
+			f = fs[i]
+		}
+		lock.Unlock()
+
+		if f == nil {
+			err := fmt.Errorf("%w: %s %s", ErrNoFixture, req.Method, req.URL)
+			Log.Error(err)
+			return nil, DownloaderErr{err, req, nil}
+		}
+		resp, err = f.response(req)
+		if err != nil {
+			return nil, DownloaderErr{err, req, nil}
+		}
+		return resp, nil
+	}
+}
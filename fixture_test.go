@@ -0,0 +1,89 @@
+package goribot
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFixtures(t *testing.T) {
+	var hits int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		switch r.URL.Path {
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write([]byte{0xff, 0xfe, 0x00})
+		case "/post":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(body)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = fmt.Fprintf(w, `<html><body><a href="/binary">%d</a></body></html>`, n)
+		}
+	}))
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(s *Spider) (got []string) {
+		s.SetTaskPoolSize(1)
+		for i := 0; i < 2; i++ {
+			s.AddTask(GetReq(ts.URL+"/page"), func(ctx *Context) {
+				got = append(got, ctx.Resp.Dom.Find("a").Text())
+				ctx.AddTask(GetReq(ctx.Resp.Dom.Find("a").AttrOr("href", "")), func(ctx *Context) {
+					got = append(got, fmt.Sprint(ctx.Resp.Body))
+				})
+			})
+		}
+		s.AddTask(PostRawReq(ts.URL+"/post", []byte("a")), func(ctx *Context) {
+			got = append(got, ctx.Resp.Text)
+		})
+		s.AddTask(PostRawReq(ts.URL+"/post", []byte("b")), func(ctx *Context) {
+			got = append(got, ctx.Resp.Text)
+		})
+		s.Run()
+		return
+	}
+	recorded := run(NewSpider(RecordFixtures(dir)))
+	ts.Close()
+
+	var missing int64
+	s := NewSpider(ReplayFixtures(dir))
+	s.OnError(func(ctx *Context, err error) {
+		if errors.Is(err, ErrNoFixture) {
+			atomic.AddInt64(&missing, 1)
+		}
+	})
+	s.AddTask(GetReq(ts.URL+"/not-recorded"), func(ctx *Context) {
+		t.Error("got response without fixture")
+	})
+	replayed := run(s)
+	if fmt.Sprint(recorded) != fmt.Sprint(replayed) {
+		t.Error("wrong replayed responses", recorded, replayed)
+	}
+	if atomic.LoadInt64(&missing) != 1 {
+		t.Error("request without fixture didn't fail")
+	}
+
+	// the last response is repeated
+	d := NewBaseDownloader()
+	d.AddMiddleware(FixtureReplayer(dir))
+	for _, text := range []string{"1", "2", "2"} {
+		resp, err := d.Do(GetReq(ts.URL + "/page"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Dom.Find("a").Text() != text {
+			t.Error("wrong replayed response", resp.Text, "expected", text)
+		}
+	}
+}
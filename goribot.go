@@ -1,6 +1,7 @@
 package goribot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,23 +27,43 @@ func init() {
 	logging.SetBackend(backendFormatter)
 }
 
+const (
+	// pollWaitTime is the interval to check the scheduler when it can't notify the spider
+	pollWaitTime = 10 * time.Millisecond
+	// idleWaitTime is the longest time to wait for a notification before checking the scheduler again
+	idleWaitTime = time.Second
+)
+
 var ErrRunFinishedSpider = errors.New("running a spider which is finished,you could recreate this spider and run the new one")
+var ErrHandlerNotFound = errors.New("handler is not registered")
 
 type Task struct {
 	Request  *Request
 	Handlers []CtxHandlerFun
+	// HandlerNames are the names of handlers registered by Spider.RegisterHandler.
+	// Unlike Handlers they could be serialized, so the task could be stored and loaded by Scheduler.
+	HandlerNames []string
 }
 
 func NewTask(request *Request, handlers ...CtxHandlerFun) *Task {
 	return &Task{Request: request, Handlers: handlers}
 }
 
+// NewTaskByName creates a task with the names of registered handlers
+func NewTaskByName(request *Request, names ...string) *Task {
+	return &Task{Request: request, HandlerNames: names}
+}
+
 type CtxHandlerFun func(ctx *Context)
 
 type Spider struct {
-	Scheduler                         Scheduler
-	Downloader                        Downloader
-	AutoStop                          bool
+	Scheduler  Scheduler
+	Downloader Downloader
+	AutoStop   bool
+	// ShutdownTimeout is how long a stopping spider waits for the running tasks and items
+	ShutdownTimeout time.Duration
+	// Fingerprinter computes the hashes of requests for deduplicate extensions
+	Fingerprinter                     Fingerprinter
 	taskPool, itemPool                *ants.Pool
 	onStartHandlers, onFinishHandlers []func(s *Spider)
 	onReqHandlers                     []func(ctx *Context, req *Request) *Request
@@ -48,8 +71,13 @@ type Spider struct {
 	onRespHandlers                    []CtxHandlerFun
 	onItemHandlers                    []func(i interface{}) interface{}
 	onErrorHandlers                   []func(ctx *Context, err error)
-	newTask                           chan struct{}
-	isWaiting                         bool
+	namedHandlers                     map[string]CtxHandlerFun
+	taskFinished, itemFinished        chan struct{}
+	runningTasks, runningItems        int64
+	stopLock                          sync.Mutex
+	stop                              context.CancelFunc
+	taskWg, itemWg                    sync.WaitGroup
+	stats                             *stats
 }
 
 func NewSpider(exts ...func(s *Spider)) *Spider {
@@ -62,13 +90,17 @@ func NewSpider(exts ...func(s *Spider)) *Spider {
 		panic(err)
 	}
 	s := &Spider{
-		Scheduler:  NewBaseScheduler(false),
-		Downloader: NewBaseDownloader(),
-		taskPool:   tp,
-		itemPool:   ip,
-		AutoStop:   true,
-		newTask:    make(chan struct{}),
-		isWaiting:  false,
+		Scheduler:       NewBaseScheduler(false),
+		Downloader:      NewBaseDownloader(),
+		taskPool:        tp,
+		itemPool:        ip,
+		AutoStop:        true,
+		ShutdownTimeout: 30 * time.Second,
+		Fingerprinter:   DefaultFingerprinter,
+		taskFinished:    make(chan struct{}, 1),
+		itemFinished:    make(chan struct{}, 1),
+		namedHandlers:   map[string]CtxHandlerFun{},
+		stats:           newStats(),
 	}
 	s.Use(exts...)
 	return s
@@ -83,19 +115,54 @@ func (s *Spider) SetItemPoolSize(i int) {
 }
 
 func (s *Spider) AddTask(request *Request, handlers ...CtxHandlerFun) {
-	if request.Depth == -1 {
-		request.Depth = 1
+	s.addTask(NewTask(request, handlers...))
+}
+
+// AddTaskByName adds a seed task whose handlers are registered by RegisterHandler
+func (s *Spider) AddTaskByName(request *Request, names ...string) {
+	s.addTask(NewTaskByName(request, names...))
+}
+
+func (s *Spider) addTask(t *Task) {
+	if t.Request.Depth == -1 {
+		t.Request.Depth = 1
 	}
-	t := NewTask(request, handlers...)
 	t = s.handleOnAdd(nil, t)
 	if t != nil {
+		s.stats.taskAdded()
 		s.Scheduler.AddTask(t)
 	}
-	if s.AutoStop == false && s.isWaiting {
-		go func() {
-			s.newTask <- struct{}{}
-		}()
+}
+
+// Stats returns a snapshot of the crawl statistics
+func (s *Spider) Stats() Stats {
+	res := s.stats.snapshot()
+	res.RunningTasks = atomic.LoadInt64(&s.runningTasks)
+	res.RunningItems = atomic.LoadInt64(&s.runningItems)
+	return res
+}
+
+// RegisterHandler registers a handler with name, so tasks could refer to it by Task.HandlerNames.
+// Register all handlers before Run.
+func (s *Spider) RegisterHandler(name string, fn CtxHandlerFun) {
+	s.namedHandlers[name] = fn
+}
+
+// taskHandlers returns the handlers of task and its registered handlers in order
+func (s *Spider) taskHandlers(t *Task) ([]CtxHandlerFun, error) {
+	if len(t.HandlerNames) == 0 {
+		return t.Handlers, nil
+	}
+	handlers := make([]CtxHandlerFun, 0, len(t.Handlers)+len(t.HandlerNames))
+	handlers = append(handlers, t.Handlers...)
+	for _, name := range t.HandlerNames {
+		fn, ok := s.namedHandlers[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrHandlerNotFound, name)
+		}
+		handlers = append(handlers, fn)
 	}
+	return handlers, nil
 }
 
 func (s *Spider) Use(fn ...func(s *Spider)) {
@@ -105,146 +172,306 @@ func (s *Spider) Use(fn ...func(s *Spider)) {
 }
 
 func (s *Spider) Run() {
+	s.RunContext(context.Background())
+}
+
+// RunContext runs the spider like Run, and it could be stopped by cancelling ctx or calling Stop.
+// After that spider stops getting tasks from Scheduler, waits ShutdownTimeout for the running tasks
+// and items, cancels the requests still in flight and waits ShutdownTimeout again for them,
+// and finally calls OnFinish handlers. The tasks ignoring the cancellation are left running.
+func (s *Spider) RunContext(ctx context.Context) {
 	defer s.taskPool.Release()
 	defer s.itemPool.Release()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.stopLock.Lock()
+	s.stop = cancel
+	s.stopLock.Unlock()
+	reqCtx, cancelReq := context.WithCancel(context.Background())
+	defer cancelReq()
+
+	s.stats.started()
 	s.handleOnStart()
-	taskRunning := true
-	if s.itemPool.Cap() > 0 {
-		go func() {
-			for taskRunning {
-				if s.itemPool.Free() > 0 {
-					if i := s.Scheduler.GetItem(); i != nil {
-						err := s.itemPool.Submit(func() {
-							s.handleOnItem(i)
-						})
-						if errors.Is(err, ants.ErrPoolClosed) {
-							panic(ErrRunFinishedSpider)
-						}
-					}
-				}
-				if s.Scheduler.IsItemEmpty() {
-					time.Sleep(500 * time.Microsecond)
-				}
-				runtime.Gosched()
+	tasksDone, stopItems, itemsDone := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go s.runItems(tasksDone, stopItems, itemsDone)
+
+	taskNotify, _ := schedulerNotify(s.Scheduler)
+	for ctx.Err() == nil {
+		full := atomic.LoadInt64(&s.runningTasks) >= int64(s.taskPool.Cap())
+		if !full {
+			if t := s.Scheduler.GetTask(); t != nil {
+				s.stats.taskTaken()
+				s.submitTask(t, reqCtx)
+				continue
 			}
-		}()
+			if s.AutoStop && atomic.LoadInt64(&s.runningTasks) == 0 && s.Scheduler.IsTaskEmpty() {
+				break
+			}
+		}
+		wait := idleWaitTime
+		if !full && (taskNotify == nil || !s.Scheduler.IsTaskEmpty()) {
+			wait = pollWaitTime
+			// only delayed tasks left, new tasks are notified
+			if d, ok := nextTaskWait(s.Scheduler, idleWaitTime); ok && taskNotify != nil {
+				wait = d
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-taskNotify:
+		case <-s.taskFinished:
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	var deadline <-chan time.Time
+	if ctx.Err() != nil {
+		Log.Info("Spider stopping, waiting for running tasks and items")
+		timer := time.NewTimer(s.ShutdownTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	if !waitGroupTimeout(&s.taskWg, deadline) {
+		Log.Warning("Shutdown timeout, cancel the running requests")
+		cancelReq()
+		timer := time.NewTimer(s.ShutdownTimeout)
+		if !waitGroupTimeout(&s.taskWg, timer.C) {
+			Log.Warning("Shutdown timeout,", atomic.LoadInt64(&s.runningTasks), "tasks ignoring the cancellation are left running")
+		}
+		timer.Stop()
+		deadline = nil
+		close(stopItems)
+	}
+	close(tasksDone)
+	select {
+	case <-itemsDone:
+	case <-deadline:
+		Log.Warning("Shutdown timeout, drop the items left in scheduler")
+		close(stopItems)
+		<-itemsDone
 	}
+	s.itemWg.Wait()
+	s.stats.finished()
+	Log.Info("Spider finished\n" + s.Stats().String())
+	s.handleOnFinish()
+}
 
+// Stop asks the running spider to shut down gracefully, just like cancelling the context passed to RunContext.
+func (s *Spider) Stop() {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// submitTask submits the task to task pool
+func (s *Spider) submitTask(t *Task, reqCtx context.Context) {
+	s.taskWg.Add(1)
+	atomic.AddInt64(&s.runningTasks, 1)
+	err := s.taskPool.Submit(func() {
+		defer s.taskWg.Done()
+		defer notify(s.taskFinished)
+		defer atomic.AddInt64(&s.runningTasks, -1)
+		s.handleTask(t, reqCtx)
+	})
+	if err != nil {
+		atomic.AddInt64(&s.runningTasks, -1)
+		s.taskWg.Done()
+		if errors.Is(err, ants.ErrPoolClosed) {
+			panic(ErrRunFinishedSpider)
+		}
+	}
+}
+
+// runItems submits items to item pool until tasks are done and all items are taken or stop is closed
+func (s *Spider) runItems(tasksDone, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if s.itemPool.Cap() <= 0 {
+		<-tasksDone
+		return
+	}
+	_, itemNotify := schedulerNotify(s.Scheduler)
+	finishing := tasksDone
 	for {
-		if s.taskPool.Free() > 0 {
-			s.isWaiting = false
-			if t := s.Scheduler.GetTask(); t != nil {
-				err := s.taskPool.Submit(func() {
-					ctx := &Context{
-						Req:      t.Request,
-						Resp:     nil,
-						tasks:    []*Task{},
-						items:    []interface{}{},
-						Meta:     t.Request.Meta,
-						Handlers: t.Handlers,
-						abort:    false,
-					}
-					defer func() { // 回收Task和Item
-						defer func() { // 回收时的错误处理
-							if r := recover(); r != nil {
-								var err error
-								switch x := r.(type) {
-								case string:
-									err = errors.New(x)
-								case error:
-									err = x
-								default:
-									err = errors.New(fmt.Sprintf("%+v", r))
-								}
-								Log.Error("recovered from error", r, "\n", string(debug.Stack()))
-								s.handleOnError(ctx, err)
-							}
-						}()
-						for _, i := range ctx.tasks {
-							if !i.Request.URL.IsAbs() {
-								i.Request.URL = ctx.Resp.Request.URL.ResolveReference(i.Request.URL)
-							}
-							if i.Request.Depth == -1 {
-								i.Request.Depth = ctx.Req.Depth + 1
-							}
-							i := s.handleOnAdd(ctx, i)
-							if i != nil {
-								s.Scheduler.AddTask(i)
-								if s.AutoStop == false && s.isWaiting {
-									go func() {
-										s.newTask <- struct{}{}
-									}()
-								}
-							}
-						}
-						for _, i := range ctx.items {
-							s.Scheduler.AddItem(i)
-						}
-					}()
-					defer func() { // 主回调函数异常处理
-						if r := recover(); r != nil {
-							var err error
-							switch x := r.(type) {
-							case string:
-								err = errors.New(x)
-							case error:
-								err = x
-							default:
-								err = errors.New(fmt.Sprintf("%+v", r))
-							}
-							Log.Error("recovered from error", r, "\n", string(debug.Stack()))
-							s.handleOnError(ctx, err)
-						}
-					}()
-					req := s.handleOnReq(ctx, t.Request)
-					if req.Err != nil {
-						s.handleOnError(ctx, req.Err)
-						return
-					}
-					if req != nil {
-						resp, err := s.Downloader.Do(req)
-						ctx.Resp = resp
-						if err == nil {
-							ctx.Meta = resp.Meta
-							if ctx.Resp.Text == "" {
-								_ = ctx.Resp.DecodeAndParse()
-							}
-							s.handleOnResp(ctx)
-							for _, fn := range t.Handlers {
-								if ctx.IsAborted() {
-									break
-								}
-								fn(ctx)
-							}
-						} else {
-							s.handleOnError(ctx, err)
-						}
-					}
-				})
-				if errors.Is(err, ants.ErrPoolClosed) {
-					panic(ErrRunFinishedSpider)
-				}
-			} else if s.taskPool.Running() == 0 {
-				if s.AutoStop {
-					break
-				} else {
-					s.isWaiting = true
-					select {
-					case _ = <-time.After(5 * time.Second):
-						break
-					case _ = <-s.newTask:
-						break
-					}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		full := atomic.LoadInt64(&s.runningItems) >= int64(s.itemPool.Cap())
+		if !full {
+			if i := s.Scheduler.GetItem(); i != nil {
+				s.submitItem(i)
+				continue
+			}
+			if finishing == nil { // no more items after tasks done
+				return
+			}
+		}
+		wait := idleWaitTime
+		if !full && itemNotify == nil {
+			wait = pollWaitTime
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-itemNotify:
+		case <-s.itemFinished:
+		case <-finishing:
+			finishing = nil
+		case <-stop:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// submitItem submits the item to item pool
+func (s *Spider) submitItem(i interface{}) {
+	s.itemWg.Add(1)
+	atomic.AddInt64(&s.runningItems, 1)
+	err := s.itemPool.Submit(func() {
+		defer s.itemWg.Done()
+		defer notify(s.itemFinished)
+		defer atomic.AddInt64(&s.runningItems, -1)
+		s.stats.item()
+		s.handleOnItem(i)
+		if d, ok := s.Scheduler.(ItemDoneScheduler); ok {
+			d.ItemDone(i)
+		}
+	})
+	if err != nil {
+		atomic.AddInt64(&s.runningItems, -1)
+		s.itemWg.Done()
+		if errors.Is(err, ants.ErrPoolClosed) {
+			panic(ErrRunFinishedSpider)
+		}
+	}
+}
+
+// handleTask downloads the request of task and calls the handlers with a new context,
+// reqCtx is used to cancel the request when spider shutting down.
+func (s *Spider) handleTask(t *Task, reqCtx context.Context) {
+	handlers, err := s.taskHandlers(t)
+	ctx := &Context{
+		Req:      t.Request,
+		Resp:     nil,
+		tasks:    []*Task{},
+		items:    []interface{}{},
+		Meta:     t.Request.Meta,
+		Handlers: handlers,
+		task:     t,
+		abort:    false,
+	}
+	if d, ok := s.Scheduler.(TaskDoneScheduler); ok {
+		defer func() {
+			// the failed or cancelled task is kept for the next run
+			if !ctx.unfinished && reqCtx.Err() == nil {
+				d.TaskDone(t)
+			}
+		}()
+	}
+	if err != nil {
+		ctx.unfinished = true
+		s.handleOnError(ctx, err)
+		return
+	}
+	defer func() { // 回收Task和Item
+		defer func() { // 回收时的错误处理
+			if r := recover(); r != nil {
+				var err error
+				switch x := r.(type) {
+				case string:
+					err = errors.New(x)
+				case error:
+					err = x
+				default:
+					err = errors.New(fmt.Sprintf("%+v", r))
 				}
+				Log.Error("recovered from error", r, "\n", string(debug.Stack()))
+				s.handleOnError(ctx, err)
+			}
+		}()
+		for _, i := range ctx.tasks {
+			if !i.Request.URL.IsAbs() {
+				i.Request.URL = ctx.Resp.Request.URL.ResolveReference(i.Request.URL)
+			}
+			if i.Request.Depth == -1 {
+				i.Request.Depth = ctx.Req.Depth + 1
+			}
+			i := s.handleOnAdd(ctx, i)
+			if i != nil {
+				s.stats.taskAdded()
+				s.Scheduler.AddTask(i)
 			}
 		}
-		if s.Scheduler.IsTaskEmpty() {
-			time.Sleep(500 * time.Microsecond)
+		for _, i := range ctx.items {
+			s.stats.itemAdded()
+			s.Scheduler.AddItem(i)
 		}
-		runtime.Gosched()
+	}()
+	defer func() { // 主回调函数异常处理
+		if r := recover(); r != nil {
+			var err error
+			switch x := r.(type) {
+			case string:
+				err = errors.New(x)
+			case error:
+				err = x
+			default:
+				err = errors.New(fmt.Sprintf("%+v", r))
+			}
+			Log.Error("recovered from error", r, "\n", string(debug.Stack()))
+			s.handleOnError(ctx, err)
+		}
+	}()
+	req := s.handleOnReq(ctx, t.Request)
+	if req == nil {
+		return
+	}
+	if req.Err != nil {
+		s.handleOnError(ctx, req.Err)
+		return
+	}
+	if req.Context() == context.Background() {
+		req.Request = req.Request.WithContext(reqCtx)
+	}
+	s.stats.request()
+	start := time.Now()
+	resp, err := s.Downloader.Do(req)
+	ctx.Resp = resp
+	if err == nil {
+		s.stats.response(req.URL.Host, resp.StatusCode, len(resp.Body), time.Since(start))
+		if resp.BodyReader != nil {
+			body := &countReadCloser{ReadCloser: resp.BodyReader}
+			resp.BodyReader = body
+			defer func() {
+				if err := resp.CloseBody(); err != nil {
+					Log.Error("close response body error", err)
+				}
+				s.stats.streamed(body.n)
+			}()
+		}
+		ctx.Meta = resp.Meta
+		if ctx.Resp.Text == "" {
+			_ = ctx.Resp.DecodeAndParse()
+		}
+		start = time.Now()
+		defer func() { s.stats.handled(time.Since(start)) }()
+		s.handleOnResp(ctx)
+		for _, fn := range handlers {
+			if ctx.IsAborted() {
+				break
+			}
+			fn(ctx)
+		}
+	} else {
+		s.stats.failed(req.URL.Host, time.Since(start))
+		ctx.unfinished = true
+		s.handleOnError(ctx, err)
 	}
-	taskRunning = false
-	s.handleOnFinish()
 }
 
 /*************************************************************************************/
@@ -346,6 +573,7 @@ func (s *Spider) OnError(fn func(ctx *Context, err error)) {
 	s.onErrorHandlers = append(s.onErrorHandlers, fn)
 }
 func (s *Spider) handleOnError(ctx *Context, err error) {
+	s.stats.error(err)
 	for _, fn := range s.onErrorHandlers {
 		fn(ctx, err)
 	}
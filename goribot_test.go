@@ -1,30 +1,37 @@
 package goribot
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBasic(t *testing.T) {
 	s := NewSpider()
-	r := 0
+	var r int64
 	s.OnStart(func(s *Spider) {
 		t.Log("OnStart")
-		r += 1
+		atomic.AddInt64(&r, 1)
 	})
 	s.OnAdd(func(ctx *Context, ta *Task) *Task {
 		t.Log("OnAdd")
-		r += 1
+		atomic.AddInt64(&r, 1)
 		return ta
 	})
 	s.OnReq(func(ctx *Context, req *Request) *Request {
 		t.Log("OnReq")
-		r += 1
+		atomic.AddInt64(&r, 1)
 		return req
 	})
 	s.OnResp(func(ctx *Context) {
 		t.Log("OnResp")
-		r += 1
+		atomic.AddInt64(&r, 1)
 	})
 	s.AddTask(
 		GetReq("https://httpbin.org/get").SetParam(map[string]string{
@@ -34,7 +41,7 @@ func TestBasic(t *testing.T) {
 			if ctx.Meta["test"] != "hello world" {
 				t.Error("wrong meta data")
 			}
-			r += 1
+			atomic.AddInt64(&r, 1)
 			t.Log("got resp data", ctx.Resp.Text)
 			if ctx.Resp.Json("args.Goribot test").String() != "hello world" {
 				t.Error("wrong resp data: " + ctx.Resp.Json("args.Goribot test").String() + " " + ctx.Resp.Text)
@@ -48,20 +55,20 @@ func TestBasic(t *testing.T) {
 	)
 	s.OnItem(func(i interface{}) interface{} {
 		t.Log("OnItem")
-		r += 1
+		atomic.AddInt64(&r, 1)
 		//panic("unexpect error")
 		return i
 	})
 	s.OnError(func(ctx *Context, err error) {
 		t.Log(err)
-		r += 1
+		atomic.AddInt64(&r, 1)
 	})
 	s.OnFinish(func(s *Spider) {
 		t.Log("OnFinish")
-		r += 1
+		atomic.AddInt64(&r, 1)
 	})
 	s.Run()
-	if r != 8 {
+	if atomic.LoadInt64(&r) != 8 {
 		t.Error("handlers miss " + fmt.Sprint(r))
 	}
 }
@@ -85,3 +92,179 @@ func TestAbort(t *testing.T) {
 		t.Error("didn't get response")
 	}
 }
+
+func TestRunContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+
+	s := NewSpider()
+	s.AutoStop = false
+	var got, items int64
+	s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+		atomic.AddInt64(&got, 1)
+		ctx.AddItem(ctx.Resp.Text)
+	})
+	s.OnItem(func(i interface{}) interface{} {
+		atomic.AddInt64(&items, 1)
+		return i
+	})
+	finished := false
+	s.OnFinish(func(s *Spider) {
+		finished = true
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	s.RunContext(ctx)
+	if time.Since(start) > 10*time.Second {
+		t.Error("spider didn't stop in time")
+	}
+	if !finished {
+		t.Error("OnFinish handlers not called")
+	}
+	if atomic.LoadInt64(&got) != 1 || atomic.LoadInt64(&items) != 1 {
+		t.Error("lost task or item", got, items)
+	}
+}
+
+func TestStop(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	s := NewSpider()
+	s.AutoStop = false
+	s.ShutdownTimeout = 500 * time.Millisecond
+	var canceled int64
+	s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+		t.Error("request should be cancelled")
+	})
+	s.OnError(func(ctx *Context, err error) {
+		if errors.Is(err, context.Canceled) {
+			atomic.AddInt64(&canceled, 1)
+		}
+	})
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		s.Stop()
+	}()
+	start := time.Now()
+	s.Run()
+	if time.Since(start) > 5*time.Second {
+		t.Error("spider didn't stop in time")
+	}
+	if atomic.LoadInt64(&canceled) != 1 {
+		t.Error("in-flight request wasn't cancelled")
+	}
+}
+
+func TestStopStuckTasks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	block := make(chan struct{})
+	defer close(block)
+
+	s := NewSpider(Limiter(false, &LimitRule{Glob: "127.0.0.1*", Delay: time.Hour}))
+	s.AutoStop = false
+	s.ShutdownTimeout = 300 * time.Millisecond
+	var limited int64
+	s.OnError(func(ctx *Context, err error) {
+		if errors.Is(err, context.Canceled) {
+			atomic.AddInt64(&limited, 1)
+		}
+	})
+	s.AddTask(GetReq(ts.URL+"/stuck"), func(ctx *Context) {
+		<-block // ignores the cancellation
+	})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.AddTask(GetReq(ts.URL + "/delayed")) // waits for the delay of Limiter
+		time.Sleep(200 * time.Millisecond)
+		s.Stop()
+	}()
+	start := time.Now()
+	s.Run()
+	if time.Since(start) > 3*time.Second {
+		t.Error("spider didn't stop in time", time.Since(start))
+	}
+	if atomic.LoadInt64(&limited) != 1 {
+		t.Error("waiting of Limiter isn't cancelled")
+	}
+}
+
+func TestSpiderConcurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+
+	const workers, each = 8, 50
+	s := NewSpider()
+	s.AutoStop = false
+	s.SetTaskPoolSize(4)
+	var got, items int64
+	handler := func(ctx *Context) {
+		ctx.AddItem(atomic.AddInt64(&got, 1))
+		if atomic.LoadInt64(&got) == workers*each {
+			s.Stop()
+		}
+	}
+	s.OnItem(func(i interface{}) interface{} {
+		atomic.AddInt64(&items, 1)
+		return i
+	})
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				s.AddTask(GetReq(ts.URL), handler)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	wg.Wait()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("spider didn't stop in time")
+	}
+	if atomic.LoadInt64(&got) != workers*each || atomic.LoadInt64(&items) != workers*each {
+		t.Error("lost task or item", got, items)
+	}
+}
+
+// BenchmarkSpider is the same as _examples/benchmark.go but with a local server
+func BenchmarkSpider(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	s := NewSpider()
+	s.SetTaskPoolSize(100)
+	s.SetItemPoolSize(0)
+	for i := 0; i < b.N; i++ {
+		s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+			if ctx.Resp.Text != "Hello goribot" {
+				b.Error("wrong response text", ctx.Resp.Text)
+			}
+		})
+	}
+	b.ResetTimer()
+	s.Run()
+}
@@ -0,0 +1,297 @@
+package goribot
+
+import (
+	"crypto/md5"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response stored in CacheStore
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	// Body is the raw content of the response before character decoding
+	Body []byte
+	// Time is when the response was downloaded or validated last time
+	Time time.Time
+	// VaryHeader is the request header named by the Vary header of response,
+	// the response is only used for the requests with the same values.
+	VaryHeader http.Header
+}
+
+// CacheStore stores the responses cached by HTTPCache
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, r *CachedResponse) error
+	Delete(key string) error
+}
+
+// MemoryCacheStore is a CacheStore keeps responses in memory
+type MemoryCacheStore struct {
+	lock      sync.RWMutex
+	responses map[string]*CachedResponse
+}
+
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{responses: map[string]*CachedResponse{}}
+}
+
+func (s *MemoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r, ok := s.responses[key]
+	return r, ok
+}
+
+func (s *MemoryCacheStore) Set(key string, r *CachedResponse) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responses[key] = r
+	return nil
+}
+
+func (s *MemoryCacheStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.responses, key)
+	return nil
+}
+
+// DiskCacheStore is a CacheStore saves every response as a file in a directory
+type DiskCacheStore struct {
+	dir string
+}
+
+// NewDiskCacheStore creates a DiskCacheStore in dir, the dir will be created if not exists
+func NewDiskCacheStore(dir string) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCacheStore{dir: dir}, nil
+}
+
+func (s *DiskCacheStore) path(key string) string {
+	h := md5.Sum([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:]))
+}
+
+func (s *DiskCacheStore) Get(key string) (*CachedResponse, bool) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log.Error("read cache error", err)
+		}
+		return nil, false
+	}
+	defer f.Close()
+	r := &CachedResponse{}
+	if err := gob.NewDecoder(f).Decode(r); err != nil {
+		Log.Error("decode cache error", err)
+		return nil, false
+	}
+	return r, true
+}
+
+func (s *DiskCacheStore) Set(key string, r *CachedResponse) error {
+	f, err := ioutil.TempFile(s.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(key))
+}
+
+func (s *DiskCacheStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// HTTPCache is an extension caches the responses of GET requests in store.
+// It sends conditional requests with If-None-Match and If-Modified-Since for the cached responses
+// and serves them without requesting while they are fresh according to Cache-Control and Expires.
+// A response with Vary header is only used for the requests with the same values of those headers,
+// and the ones with "Vary: *" are not cached.
+// forceCache makes it cache every successful response and never request again, it's useful for development.
+func HTTPCache(store CacheStore, forceCache bool) func(s *Spider) {
+	return func(s *Spider) {
+		s.Downloader.AddMiddleware(CacheMiddleware(store, forceCache))
+	}
+}
+
+// CacheMiddleware returns the Downloader middleware used by HTTPCache
+func CacheMiddleware(store CacheStore, forceCache bool) func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+	return func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+		if req.Err != nil || req.Method != http.MethodGet {
+			return next(req)
+		}
+		key := cacheKey(req)
+		cached, ok := store.Get(key)
+		if ok && !cached.matches(req.Header) {
+			cached, ok = nil, false
+		}
+		if ok {
+			if forceCache || (cached.fresh(time.Now()) && !cacheControl(req.Header).has("no-cache")) {
+				return cached.response(req), nil
+			}
+			if etag := cached.Header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == "" {
+				req.Header.Set("If-None-Match", etag)
+				defer req.Header.Del("If-None-Match")
+			}
+			if lm := cached.Header.Get("Last-Modified"); lm != "" && req.Header.Get("If-Modified-Since") == "" {
+				req.Header.Set("If-Modified-Since", lm)
+				defer req.Header.Del("If-Modified-Since")
+			}
+		}
+		resp, err = next(req)
+		if err != nil {
+			return resp, err
+		}
+		if ok && resp.StatusCode == http.StatusNotModified {
+			validated := *cached
+			validated.Header = cached.Header.Clone()
+			for k, v := range resp.Header {
+				if k != "Content-Length" {
+					validated.Header[k] = v
+				}
+			}
+			validated.Time = time.Now()
+			cached = &validated
+			if err := store.Set(key, cached); err != nil {
+				Log.Error("save cache error", err)
+			}
+			res := cached.response(req)
+			res.Request = resp.Request
+			return res, nil
+		}
+		vary, varyOk := varyHeader(resp.Header, req.Header)
+		if resp.StatusCode == http.StatusOK && resp.BodyReader == nil && varyOk && (forceCache || storable(resp.Header)) {
+			err := store.Set(key, &CachedResponse{
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header.Clone(),
+				Body:       resp.RawBody,
+				Time:       time.Now(),
+				VaryHeader: vary,
+			})
+			if err != nil {
+				Log.Error("save cache error", err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+// cacheKey returns the key of request in CacheStore
+func cacheKey(req *Request) string {
+	key := req.Method + " " + req.URL.String()
+	if body := req.GetBody(); len(body) > 0 {
+		h := md5.Sum(body)
+		key += " " + hex.EncodeToString(h[:])
+	}
+	return key
+}
+
+// fresh reports whether the response could be used without validation
+func (r *CachedResponse) fresh(now time.Time) bool {
+	cc := cacheControl(r.Header)
+	if cc.has("no-cache") || cc.has("no-store") {
+		return false
+	}
+	if v, ok := cc["max-age"]; ok {
+		age, err := strconv.Atoi(v)
+		return err == nil && now.Sub(r.Time) < time.Duration(age)*time.Second
+	}
+	if v := r.Header.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		return err == nil && now.Before(t)
+	}
+	return false
+}
+
+// varyHeader returns the values of request header named by the Vary header of response, ok is false for "Vary: *"
+func varyHeader(resp, req http.Header) (h http.Header, ok bool) {
+	h = http.Header{}
+	for _, v := range resp["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				h[name] = req[name]
+			}
+		}
+	}
+	return h, true
+}
+
+// matches reports whether the cached response could be used for the request with header h
+func (r *CachedResponse) matches(h http.Header) bool {
+	vary, ok := varyHeader(r.Header, h)
+	if !ok {
+		return false
+	}
+	for name, v := range vary {
+		if strings.Join(v, ",") != strings.Join(r.VaryHeader[name], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// response creates a Response of req from the cached response
+func (r *CachedResponse) response(req *Request) *Response {
+	return newResponse(req, r.StatusCode, r.Header, r.Body)
+}
+
+// storable reports whether a response with the header is worth caching
+func storable(h http.Header) bool {
+	cc := cacheControl(h)
+	if cc.has("no-store") {
+		return false
+	}
+	_, maxAge := cc["max-age"]
+	return maxAge || h.Get("ETag") != "" || h.Get("Last-Modified") != "" || h.Get("Expires") != ""
+}
+
+type cacheDirectives map[string]string
+
+func (c cacheDirectives) has(d string) bool {
+	_, ok := c[d]
+	return ok
+}
+
+// cacheControl parses the Cache-Control header
+func cacheControl(h http.Header) cacheDirectives {
+	c := cacheDirectives{}
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if i := strings.Index(part, "="); i >= 0 {
+			c[strings.ToLower(part[:i])] = strings.Trim(part[i+1:], `"`)
+		} else {
+			c[strings.ToLower(part)] = ""
+		}
+	}
+	return c
+}
@@ -0,0 +1,142 @@
+package goribot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPCache(t *testing.T) {
+	var full, notModified int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt64(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		atomic.AddInt64(&full, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "<html><body><p>Hello goribot</p></body></html>")
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewDiskCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]CacheStore{"memory": NewMemoryCacheStore(), "disk": disk} {
+		atomic.StoreInt64(&full, 0)
+		atomic.StoreInt64(&notModified, 0)
+		d := NewBaseDownloader()
+		d.AddMiddleware(CacheMiddleware(store, false))
+		for _, path := range []string{"/etag", "/fresh", "/no-store"} {
+			for i := 0; i < 3; i++ {
+				resp, err := d.Do(GetReq(ts.URL + path))
+				if err != nil {
+					t.Fatal(name, err)
+				}
+				if resp.StatusCode != http.StatusOK || resp.Dom == nil || resp.Dom.Find("p").Text() != "Hello goribot" {
+					t.Error(name, "wrong response", path, resp.StatusCode, resp.Text)
+				}
+				if resp.Request == nil || resp.Request.URL.Path != path {
+					t.Error(name, "wrong request of response", path)
+				}
+			}
+		}
+		// etag: 1 full+2 not modified,fresh: 1 full,no-store: 3 full
+		if atomic.LoadInt64(&full) != 5 || atomic.LoadInt64(&notModified) != 2 {
+			t.Error(name, "wrong requests", full, notModified)
+		}
+	}
+
+	atomic.StoreInt64(&full, 0)
+	s := NewSpider(HTTPCache(NewMemoryCacheStore(), true))
+	for i := 0; i < 3; i++ {
+		s.AddTask(GetReq(ts.URL+"/no-store"), func(ctx *Context) {
+			if ctx.Resp.Text != "<html><body><p>Hello goribot</p></body></html>" {
+				t.Error("wrong response", ctx.Resp.Text)
+			}
+		})
+	}
+	s.SetTaskPoolSize(1)
+	s.Run()
+	if atomic.LoadInt64(&full) != 1 {
+		t.Error("force cache didn't work", full)
+	}
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	var full int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&full, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.URL.Path == "/star" {
+			w.Header().Set("Vary", "*")
+		} else {
+			w.Header().Set("Vary", "Accept-Encoding, accept-language")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewDiskCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]CacheStore{"memory": NewMemoryCacheStore(), "disk": disk} {
+		atomic.StoreInt64(&full, 0)
+		d := NewBaseDownloader()
+		d.AddMiddleware(CacheMiddleware(store, false))
+		for _, lang := range []string{"en", "en", "fr", "fr", ""} {
+			resp, err := d.Do(Get(ts.URL+"/vary").SetHeader("Accept-Language", lang))
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if resp.Text != lang {
+				t.Error(name, "wrong cached response for", lang, resp.Text)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := d.Do(Get(ts.URL + "/star")); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		// vary: en,fr and empty,star: 2
+		if atomic.LoadInt64(&full) != 5 {
+			t.Error(name, "wrong requests", full)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", `public, max-age=60, no-cache="Set-Cookie"`)
+	cc := cacheControl(h)
+	if cc["max-age"] != "60" || !cc.has("public") || cc["no-cache"] != "Set-Cookie" || cc.has("no-store") {
+		t.Error("wrong cache control", cc)
+	}
+}
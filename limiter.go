@@ -5,7 +5,6 @@ import (
 	"math/rand"
 	"net/url"
 	"regexp"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,22 +30,43 @@ type LimitRule struct {
 	MaxReq             int64
 	reqLeft            int64
 	MaxDepth           int64
-	lastReqTime        time.Time
-	compiledRegexp     *regexp.Regexp
-	compiledGlob       glob.Glob
-	delayLock          sync.Mutex
+	// MaxBodySize is the max size of response body for the requests without Request.MaxBodySize
+	MaxBodySize    int64
+	lastReqTime    time.Time
+	lastReq        int64
+	delayWaiting   int32
+	compiledRegexp *regexp.Regexp
+	compiledGlob   glob.Glob
+	delayLock      sync.Mutex
 }
 
+// Match reports whether the host of u normalized by NormalizeHost matches the rule
 func (s *LimitRule) Match(u *url.URL) bool {
 	match := false
+	host := NormalizeHost(u)
 	if s.compiledGlob != nil {
-		match = s.compiledGlob.Match(strings.ToLower(u.Host))
+		match = s.compiledGlob.Match(host)
 	} else {
-		match = s.compiledRegexp.MatchString(strings.ToLower(u.Host))
+		match = s.compiledRegexp.MatchString(host)
 	}
 	return match
 }
 
+// Ready reports whether a request matching the rule could be sent now without waiting for delay,rate or parallelism
+func (s *LimitRule) Ready() bool {
+	if s.Delay > 0 || s.RandomDelay > 0 {
+		if atomic.LoadInt32(&s.delayWaiting) > 0 {
+			return false
+		}
+		return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastReq))) >= s.Delay
+	} else if s.Rate > 0 {
+		return atomic.LoadInt64(&s.rateLeft) > 0
+	} else if s.Parallelism > 0 {
+		return atomic.LoadInt64(&s.workingParallelism) < s.Parallelism
+	}
+	return true
+}
+
 func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 	for k, r := range rules {
 		if r.Allow == NotSet {
@@ -61,31 +81,59 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 			rules[k].compiledRegexp = regexp.MustCompile(rules[k].Regexp)
 		}
 	}
-	rateCtl := true
+	rateStop := make(chan struct{})
+	rateStopOnce := sync.Once{}
 	go func() {
-		for rateCtl {
-			time.Sleep(1 * time.Second)
-			for k, _ := range rules {
-				atomic.StoreInt64(&rules[k].rateLeft, rules[k].Rate)
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rateStop:
+				return
+			case <-ticker.C:
+				for k, _ := range rules {
+					atomic.StoreInt64(&rules[k].rateLeft, rules[k].Rate)
+				}
 			}
 		}
 	}()
 	return func(s *Spider) {
+		if hs, ok := s.Scheduler.(*HostScheduler); ok {
+			hs.AddReadyChecker(func(u *url.URL) bool {
+				for _, r := range rules {
+					if r.Match(u) {
+						return r.Ready()
+					}
+				}
+				return true
+			})
+		}
 		s.Downloader.AddMiddleware(func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
 			for k, r := range rules {
 				if r.Match(req.URL) {
+					if r.MaxBodySize > 0 && req.MaxBodySize <= 0 {
+						req.MaxBodySize = r.MaxBodySize
+					}
 					if r.Delay > 0 || r.RandomDelay > 0 {
+						atomic.AddInt32(&rules[k].delayWaiting, 1)
 						rules[k].delayLock.Lock()
-						since := time.Since(r.lastReqTime)
-						if since < r.Delay {
-							time.Sleep(r.Delay - since)
+						var delay time.Duration
+						if since := time.Since(r.lastReqTime); since < r.Delay {
+							delay = r.Delay - since
 						}
 						if r.RandomDelay > 0 {
 							ra := rand.New(rand.NewSource(time.Now().Unix()))
-							time.Sleep(time.Duration(ra.Int63n(int64(r.RandomDelay))))
+							delay += time.Duration(ra.Int63n(int64(r.RandomDelay)))
+						}
+						if err := sleepContext(req.Context(), delay); err != nil {
+							rules[k].delayLock.Unlock()
+							atomic.AddInt32(&rules[k].delayWaiting, -1)
+							return nil, DownloaderErr{err, req, nil}
 						}
 						rules[k].lastReqTime = time.Now()
+						atomic.StoreInt64(&rules[k].lastReq, rules[k].lastReqTime.UnixNano())
 						rules[k].delayLock.Unlock()
+						atomic.AddInt32(&rules[k].delayWaiting, -1)
 						return next(req)
 					} else if r.Rate > 0 {
 						wait := true
@@ -93,8 +141,8 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 							if atomic.LoadInt64(&rules[k].rateLeft) > 0 {
 								atomic.AddInt64(&rules[k].rateLeft, -1)
 								wait = false
-							} else {
-								time.Sleep(500 * time.Microsecond)
+							} else if err := sleepContext(req.Context(), 500*time.Microsecond); err != nil {
+								return nil, DownloaderErr{err, req, nil}
 							}
 						}
 						return next(req)
@@ -104,8 +152,8 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 							if atomic.LoadInt64(&rules[k].workingParallelism) < r.Parallelism {
 								atomic.AddInt64(&rules[k].workingParallelism, 1)
 								wait = false
-							} else {
-								time.Sleep(500 * time.Microsecond)
+							} else if err := sleepContext(req.Context(), 500*time.Microsecond); err != nil {
+								return nil, DownloaderErr{err, req, nil}
 							}
 						}
 						resp, err := next(req)
@@ -122,11 +170,13 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 			for k, r := range rules {
 				if r.Match(t.Request.URL) {
 					if r.Allow == Disallow {
+						s.stats.limit()
 						return nil
 					}
 					if r.MaxDepth > 0 {
 						//fmt.Println(t.Request.Depth)
 						if int64(t.Request.Depth) > r.MaxDepth {
+							s.stats.limit()
 							return nil
 						}
 					}
@@ -134,6 +184,7 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 						if atomic.LoadInt64(&rules[k].reqLeft) > 0 {
 							atomic.AddInt64(&rules[k].reqLeft, -1)
 						} else {
+							s.stats.limit()
 							return nil
 						}
 					}
@@ -141,13 +192,14 @@ func Limiter(WhiteList bool, rules ...*LimitRule) func(s *Spider) {
 				}
 			}
 			if WhiteList {
+				s.stats.limit()
 				return nil
 			} else {
 				return t
 			}
 		})
 		s.OnFinish(func(s *Spider) {
-			rateCtl = false
+			rateStopOnce.Do(func() { close(rateStop) })
 		})
 	}
 }
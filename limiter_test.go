@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -114,7 +116,7 @@ func TestMaxReq(t *testing.T) {
 			MaxReq: 3,
 		}),
 	)
-	got := 0
+	var got int64
 	i := 0
 	for i < 5 {
 		ii := i
@@ -122,13 +124,13 @@ func TestMaxReq(t *testing.T) {
 			GetReq("https://httpbin.org/get"),
 			func(ctx *Context) {
 				Log.Info("got", ii)
-				got += 1
+				atomic.AddInt64(&got, 1)
 			},
 		)
 		i += 1
 	}
 	s.Run()
-	if got != 3 {
+	if atomic.LoadInt64(&got) != 3 {
 		t.Error("wrong req got", got)
 	}
 }
@@ -140,17 +142,17 @@ func TestMaxDepth(t *testing.T) {
 			MaxDepth: 2,
 		}),
 	)
-	got := 0
+	var got int64
 	s.AddTask(
 		GetReq("https://httpbin.org/get"),
 		func(ctx *Context) {
-			got += 1
+			atomic.AddInt64(&got, 1)
 			ctx.AddTask(GetReq("https://httpbin.org/get"), func(ctx *Context) {
-				got += 1
+				atomic.AddInt64(&got, 1)
 				ctx.AddTask(GetReq("https://httpbin.org/get"), func(ctx *Context) {
-					got += 1
+					atomic.AddInt64(&got, 1)
 					ctx.AddTask(GetReq("https://httpbin.org/get"), func(ctx *Context) {
-						got += 1
+						atomic.AddInt64(&got, 1)
 					})
 				})
 			})
@@ -158,7 +160,33 @@ func TestMaxDepth(t *testing.T) {
 	)
 
 	s.Run()
-	if got != 2 {
+	if atomic.LoadInt64(&got) != 2 {
 		t.Error("wrong req got", got)
 	}
 }
+
+func TestLimiterHostScheduler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	s := NewSpider(
+		UseHostScheduler(),
+		Limiter(false, &LimitRule{
+			Glob:  u.Host,
+			Delay: time.Hour,
+		}),
+	)
+	if _, err := s.Downloader.Do(GetReq(ts.URL)); err != nil {
+		t.Fatal(err)
+	}
+	s.Scheduler.AddTask(NewTask(GetReq(ts.URL)))
+	s.Scheduler.AddTask(NewTask(GetReq("http://example.com/")))
+	if task := s.Scheduler.GetTask(); task == nil || task.Request.URL.Host != "example.com" {
+		t.Error("should skip the host waiting for delay")
+	}
+	if s.Scheduler.GetTask() != nil || s.Scheduler.IsTaskEmpty() {
+		t.Error("the host waiting for delay should be kept")
+	}
+}
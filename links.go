@@ -0,0 +1,277 @@
+package goribot
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gobwas/glob"
+	"golang.org/x/net/html"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultLinkTags are the tags and attributes of links extracted by LinkExtractor without Tags
+var DefaultLinkTags = map[string][]string{
+	"a":    {"href"},
+	"area": {"href"},
+}
+
+// AllLinkTags are the tags and attributes of links including resources like images and frames
+var AllLinkTags = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"link":   {"href"},
+	"iframe": {"src"},
+	"frame":  {"src"},
+	"img":    {"src"},
+}
+
+// LinkExtractor extracts the absolute http and https links from html responses.
+// Relative links are resolved by the url of response and the <base> tag,
+// the links like "javascript:" and "mailto:" are skipped, and the fragments are removed.
+type LinkExtractor struct {
+	// Allow are the regexps of extracted urls, empty means all urls unless AllowGlobs is set
+	Allow []string
+	// Deny are the regexps of urls not extracted, it overrides Allow
+	Deny []string
+	// AllowGlobs and DenyGlobs are like Allow and Deny with glob patterns, see https://github.com/gobwas/glob
+	AllowGlobs, DenyGlobs []string
+	// Domains are the glob patterns of hosts extracted like "*.example.com", empty means all
+	Domains []string
+	// RestrictCSS are the css selectors of the regions to extract links from, empty means the whole page
+	RestrictCSS []string
+	// RestrictXPath are like RestrictCSS with xpath, see XPath for the supported subset
+	RestrictXPath []string
+	// Tags are the tag names and attributes of links, nil means DefaultLinkTags
+	Tags map[string][]string
+	// Normalizer normalizes the extracted urls before matching, nil means not normalizing
+	Normalizer *URLNormalizer
+
+	once                sync.Once
+	err                 error
+	allow, deny         []*regexp.Regexp
+	allowGlob, denyGlob []glob.Glob
+	domains             []glob.Glob
+	xpath               []*XPath
+}
+
+func (e *LinkExtractor) compile() error {
+	e.once.Do(func() {
+		for _, list := range []struct {
+			src []string
+			dst *[]*regexp.Regexp
+		}{{e.Allow, &e.allow}, {e.Deny, &e.deny}} {
+			for _, p := range list.src {
+				r, err := regexp.Compile(p)
+				if err != nil {
+					e.err = err
+					return
+				}
+				*list.dst = append(*list.dst, r)
+			}
+		}
+		for _, list := range []struct {
+			src []string
+			dst *[]glob.Glob
+		}{{e.AllowGlobs, &e.allowGlob}, {e.DenyGlobs, &e.denyGlob}, {e.Domains, &e.domains}} {
+			for _, p := range list.src {
+				g, err := glob.Compile(p)
+				if err != nil {
+					e.err = err
+					return
+				}
+				*list.dst = append(*list.dst, g)
+			}
+		}
+		for _, p := range e.RestrictXPath {
+			x, err := CompileXPath(p)
+			if err != nil {
+				e.err = err
+				return
+			}
+			e.xpath = append(e.xpath, x)
+		}
+	})
+	return e.err
+}
+
+// Match reports whether the absolute url is extracted by the patterns
+func (e *LinkExtractor) Match(u *url.URL) bool {
+	if err := e.compile(); err != nil {
+		panic(err)
+	}
+	s := u.String()
+	if len(e.domains) > 0 {
+		host := NormalizeHost(u)
+		ok := false
+		for _, g := range e.domains {
+			if g.Match(host) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, r := range e.deny {
+		if r.MatchString(s) {
+			return false
+		}
+	}
+	for _, g := range e.denyGlob {
+		if g.Match(s) {
+			return false
+		}
+	}
+	if len(e.allow) == 0 && len(e.allowGlob) == 0 {
+		return true
+	}
+	for _, r := range e.allow {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	for _, g := range e.allowGlob {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// regions returns the selections to extract links from
+func (e *LinkExtractor) regions(dom *goquery.Document) *goquery.Selection {
+	if len(e.RestrictCSS) == 0 && len(e.xpath) == 0 {
+		return dom.Selection
+	}
+	var nodes []*html.Node
+	for _, css := range e.RestrictCSS {
+		nodes = append(nodes, dom.Find(css).Nodes...)
+	}
+	for _, root := range dom.Nodes {
+		for _, x := range e.xpath {
+			nodes = append(nodes, x.Select(root)...)
+		}
+	}
+	return dom.FindNodes(nodes...)
+}
+
+// Extract returns the matched links of the html response in document order without duplicates
+func (e *LinkExtractor) Extract(resp *Response) []*url.URL {
+	if err := e.compile(); err != nil {
+		panic(err)
+	}
+	if resp == nil || resp.Dom == nil || resp.Request == nil {
+		return nil
+	}
+	base := resp.Request.URL
+	if href, ok := resp.Dom.Find("base[href]").First().Attr("href"); ok {
+		if u, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = u
+		}
+	}
+	tags := e.Tags
+	if tags == nil {
+		tags = DefaultLinkTags
+	}
+
+	var res []*url.URL
+	seen := map[string]struct{}{}
+	regions := e.regions(resp.Dom)
+	// regions with the elements themselves, so a restricted <a> is extracted as well
+	regions.Find("*").AddSelection(regions).Each(func(i int, sel *goquery.Selection) {
+		attrs, ok := tags[goquery.NodeName(sel)]
+		if !ok {
+			return
+		}
+		for _, attr := range attrs {
+			v, ok := sel.Attr(attr)
+			if !ok {
+				continue
+			}
+			u := resolveLink(base, v)
+			if u == nil {
+				continue
+			}
+			if e.Normalizer != nil {
+				u = e.Normalizer.Normalize(u)
+			}
+			s := u.String()
+			if _, ok := seen[s]; ok || !e.Match(u) {
+				continue
+			}
+			seen[s] = struct{}{}
+			res = append(res, u)
+		}
+	})
+	return res
+}
+
+// resolveLink returns the absolute http or https url of link without fragment, nil if it's not a web page link
+func resolveLink(base *url.URL, link string) *url.URL {
+	link = strings.TrimSpace(link)
+	if link == "" || strings.HasPrefix(link, "#") {
+		return nil
+	}
+	u, err := base.Parse(link)
+	if err != nil {
+		return nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil // javascript:,mailto:,tel:,data: and so on
+	}
+	u.Fragment = ""
+	return u
+}
+
+// LinkRule decides which links are followed and how the responses of them are handled
+type LinkRule struct {
+	// Extractor extracts the links of the rule, nil means all links of DefaultLinkTags
+	Extractor *LinkExtractor
+	// Handlers handle the responses of the links
+	Handlers []CtxHandlerFun
+	// HandlerNames are the names of handlers registered by Spider.RegisterHandler, used if Handlers is empty
+	HandlerNames []string
+	// Follow makes the links of the responses extracted by the rules again
+	Follow bool
+}
+
+// Rules is an extension extracts the links of html responses by rules and adds them as new tasks.
+// A link is added by the first rule matching it. The links of seed tasks' responses are extracted,
+// and the links of the responses of links only if the rule has Follow.
+func Rules(rules ...*LinkRule) func(s *Spider) {
+	for _, r := range rules {
+		if r.Extractor == nil {
+			r.Extractor = &LinkExtractor{}
+		}
+		if err := r.Extractor.compile(); err != nil {
+			panic(err)
+		}
+	}
+	return func(s *Spider) {
+		s.OnResp(func(ctx *Context) {
+			if follow, ok := ctx.Req.Meta["LinkFollow"].(bool); ok && !follow {
+				return
+			}
+			if ctx.Resp.Dom == nil {
+				return
+			}
+			added := map[string]struct{}{}
+			for _, r := range rules {
+				for _, u := range r.Extractor.Extract(ctx.Resp) {
+					if _, ok := added[u.String()]; ok {
+						continue
+					}
+					added[u.String()] = struct{}{}
+					req := Get(u.String()).WithMeta("LinkFollow", r.Follow)
+					if len(r.Handlers) == 0 && len(r.HandlerNames) > 0 {
+						ctx.AddTaskByName(req, r.HandlerNames...)
+					} else {
+						ctx.AddTask(req, r.Handlers...)
+					}
+				}
+			}
+		})
+	}
+}
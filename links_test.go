@@ -0,0 +1,197 @@
+package goribot
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const linksPage = `<html><head><link href="/style.css" rel="stylesheet"></head><body>
+<div id="nav"><a href="/list?page=2">next</a><a href="list?page=2#top">next again</a></div>
+<div class="content main">
+	<a href="/item/1">item 1</a>
+	<a href=" https://other.com/item/2 ">item 2</a>
+	<a href="javascript:void(0)">js</a>
+	<a href="mailto:a@example.com">mail</a>
+	<a href="#comments">comments</a>
+	<img src="/img/1.png">
+	<map><area href="/item/3"></map>
+</div>
+<ul><li><a href="/li/1">1</a></li><li><a href="/li/2">2</a></li></ul>
+</body></html>`
+
+func linksResponse(t *testing.T, rawURL, body string) *Response {
+	req := Get(rawURL)
+	if req.Err != nil {
+		t.Fatal(req.Err)
+	}
+	return newResponse(req, 200, http.Header{"Content-Type": []string{"text/html"}}, []byte(body))
+}
+
+func linkStrings(e *LinkExtractor, resp *Response) string {
+	var res []string
+	for _, u := range e.Extract(resp) {
+		res = append(res, u.String())
+	}
+	return strings.Join(res, " ")
+}
+
+func TestLinkExtractor(t *testing.T) {
+	resp := linksResponse(t, "http://example.com/dir/page", linksPage)
+	cases := []struct {
+		e    *LinkExtractor
+		want string
+	}{
+		{&LinkExtractor{}, "http://example.com/list?page=2 http://example.com/dir/list?page=2 http://example.com/item/1 https://other.com/item/2 http://example.com/item/3 http://example.com/li/1 http://example.com/li/2"},
+		{&LinkExtractor{Domains: []string{"example.com"}, Allow: []string{`/item/\d+$`}}, "http://example.com/item/1 http://example.com/item/3"},
+		{&LinkExtractor{AllowGlobs: []string{"*/item/*"}, Deny: []string{"other"}}, "http://example.com/item/1 http://example.com/item/3"},
+		{&LinkExtractor{DenyGlobs: []string{"*list*", "*/li/*"}}, "http://example.com/item/1 https://other.com/item/2 http://example.com/item/3"},
+		{&LinkExtractor{RestrictCSS: []string{"#nav"}}, "http://example.com/list?page=2 http://example.com/dir/list?page=2"},
+		{&LinkExtractor{RestrictXPath: []string{"//div[contains(@class,'main')]"}, Tags: map[string][]string{"img": {"src"}}}, "http://example.com/img/1.png"},
+		{&LinkExtractor{RestrictXPath: []string{"//ul/li[last()]"}}, "http://example.com/li/2"},
+		{&LinkExtractor{RestrictCSS: []string{"#nav a"}}, "http://example.com/list?page=2 http://example.com/dir/list?page=2"},
+		{&LinkExtractor{Tags: AllLinkTags, Allow: []string{`\.(css|png)$`}}, "http://example.com/style.css http://example.com/img/1.png"},
+		{&LinkExtractor{RestrictCSS: []string{"#nav"}, Normalizer: NewURLNormalizer(&NormalizeRule{Glob: "example.com", RemoveParams: []string{"page"}})}, "http://example.com/list http://example.com/dir/list"},
+	}
+	for i, c := range cases {
+		if res := linkStrings(c.e, resp); res != c.want {
+			t.Errorf("case %d: got %q, want %q", i, res, c.want)
+		}
+	}
+
+	resp = linksResponse(t, "http://example.com/a/b", `<html><head><base href="http://cdn.example.com/x/"></head><body><a href="y">y</a></body></html>`)
+	if res := linkStrings(&LinkExtractor{}, resp); res != "http://cdn.example.com/x/y" {
+		t.Error("base tag isn't used", res)
+	}
+}
+
+func TestXPath(t *testing.T) {
+	resp := linksResponse(t, "http://example.com/", linksPage)
+	cases := []struct {
+		expr string
+		n    int
+	}{
+		{"//a", 9},
+		{"/html/body/div", 2},
+		{"//div[@id='nav']/a", 2},
+		{"//div[@id=\"nav\"]/a[2]", 1},
+		{"//li[1]/a", 1},
+		{"//li/a[1]", 2},
+		{"//*[@href]", 11},
+		{"//a[starts-with(@href,'/item') and text()='item 1']", 1},
+		{"//a[text()!='next']", 8},
+		{"//div[@class='content']", 0},
+		{"//a[text()='item 1' and .='item 1']", 1},
+	}
+	for _, c := range cases {
+		if n := len(MustCompileXPath(c.expr).Select(resp.Dom.Nodes[0])); n != c.n {
+			t.Errorf("%s selected %d nodes, want %d", c.expr, n, c.n)
+		}
+	}
+	nested := linksResponse(t, "http://example.com/", `<p><a href="/1"><span>next</span></a><a href="/2">next <b>page</b></a><a href="/3">next</a><a href="/4" title="a,b" data-x="">a,b</a></p>`)
+	for expr, want := range map[string]string{
+		"//a[text()='next']":              "/3",
+		"//a[.='next']":                   "/1 /3",
+		"//a[contains(text(),'page')]":    "",
+		"//a[contains(.,'page')]":         "/2",
+		"//a[text()]":                     "/2 /3 /4",
+		"//a[@data-x]":                    "/4",
+		"//a[@title='a,b']":               "/4",
+		"//a[contains(@title,'a,b')]":     "/4",
+		"//a[contains(@title, \"b\")]":    "/4",
+		"//a[contains('a,b,c',text())]":   "/4",
+		"//a[starts-with(@title,'a,')]":   "/4",
+		"//a[contains(@title,@data-x)]":   "/4",
+		"//a[contains('next page',.)]":    "/1 /2 /3",
+		"//a[starts-with('a,b','a,b,c')]": "",
+	} {
+		var res []string
+		for _, n := range MustCompileXPath(expr).Select(nested.Dom.Nodes[0]) {
+			for _, a := range n.Attr {
+				if a.Key == "href" {
+					res = append(res, a.Val)
+				}
+			}
+		}
+		if strings.Join(res, " ") != want {
+			t.Errorf("%s selected %v, want %q", expr, res, want)
+		}
+	}
+
+	for _, expr := range []string{"div", "a/b", "//a[", "//a[@href=x]", "//a[position()=1]", "//a/@href", "//a/..", "//a/parent::div",
+		"//a[@id='1' or @id='2']", "//a[not(@href)]", "//a[@id='1' or @id='2' and @href]", "//a[@id='a'b']",
+		"//a[contains(@title)]", "//a[contains(@title,'a','b')]", "//a[contains(@title,'a)]", "//a[contains(x,'a')]"} {
+		if _, err := CompileXPath(expr); err == nil {
+			t.Error("no error for", expr)
+		}
+	}
+}
+
+func TestXPathEmptyText(t *testing.T) {
+	root := &html.Node{Type: html.DocumentNode}
+	for _, text := range []string{"", "x"} {
+		a := &html.Node{Type: html.ElementNode, Data: "a", Attr: []html.Attribute{{Key: "title"}}}
+		a.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+		root.AppendChild(a)
+	}
+	root.AppendChild(&html.Node{Type: html.ElementNode, Data: "a"})
+	if n := len(MustCompileXPath("//a[text()]").Select(root)); n != 2 {
+		t.Error("empty text node isn't selected", n)
+	}
+	if n := len(MustCompileXPath("//a[@title]").Select(root)); n != 2 {
+		t.Error("empty attribute isn't selected", n)
+	}
+}
+
+func TestRules(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch {
+		case r.URL.Path == "/", strings.HasPrefix(r.URL.Path, "/list/"):
+			var n int
+			fmt.Sscanf(r.URL.Path, "/list/%d", &n)
+			if n < 3 {
+				fmt.Fprintf(w, `<a href="/list/%d">next</a>`, n+1)
+			}
+			fmt.Fprintf(w, `<div class="items"><a href="/item/%d">item</a><a href="mailto:a@b.c">mail</a></div>`, n)
+		default:
+			fmt.Fprint(w, `<a href="/list/100">should not be followed</a>`)
+		}
+	}))
+	defer ts.Close()
+
+	lock := sync.Mutex{}
+	items := map[string]int{}
+	s := NewSpider(
+		Rules(
+			&LinkRule{
+				Extractor: &LinkExtractor{RestrictCSS: []string{".items"}},
+				Handlers: []CtxHandlerFun{func(ctx *Context) {
+					lock.Lock()
+					items[ctx.Req.URL.Path] += 1
+					lock.Unlock()
+				}},
+			},
+			&LinkRule{Extractor: &LinkExtractor{Allow: []string{`/list/\d+$`}}, Follow: true},
+		),
+		ReqDeduplicate(),
+	)
+	s.AddTask(Get(ts.URL))
+	s.Run()
+
+	if len(items) != 4 {
+		t.Error("wrong items", items)
+	}
+	for p, n := range items {
+		if n != 1 || !strings.HasPrefix(p, "/item/") {
+			t.Error("wrong item", p, n)
+		}
+	}
+	if st := s.Stats(); st.Requests != 8 {
+		t.Error("wrong requests", st.Requests)
+	}
+}
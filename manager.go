@@ -7,14 +7,57 @@ import (
 	"fmt"
 	"github.com/go-redis/redis"
 	"github.com/panjf2000/ants/v2"
+	"net/http"
 	"runtime"
+	"strconv"
 	"time"
 )
 
 const ItemsSuffix = "_items"
 const TasksSuffix = "_tasks"
+
+// DeduplicateSuffix is the suffix of the set keeps the hashes by GetRequestHash of the old versions.
+// It's not used any more, but still cleared by Manager.Run.
 const DeduplicateSuffix = "_deduplicate"
 
+// FingerprintSuffix is the suffix of the set keeps the request fingerprints by Spider.Fingerprinter for RedisReqDeduplicate
+const FingerprintSuffix = "_fingerprint"
+
+// DelayedSuffix is the suffix of the sorted set keeps the tasks waiting for Request.NotBefore, scored by unix time
+const DelayedSuffix = "_delayed"
+
+// pushRedisTask sends the encoded task to the tasks list, or the delayed sorted set if its NotBefore is in the future
+func pushRedisTask(r *redis.Client, sName string, t *Task, data []byte) error {
+	if isDelayed(t, time.Now()) {
+		score := float64(t.Request.NotBefore.UnixNano()) / float64(time.Second)
+		return r.ZAdd(sName+DelayedSuffix, redis.Z{Score: score, Member: data}).Err()
+	}
+	return r.LPush(sName+TasksSuffix, data).Err()
+}
+
+// decodeRedisTask decodes a task sent by Manager.SendReq or RedisScheduler.AddTask.
+// The old versions of Manager.SendReq sent the gob of Request, it's still decoded as a seed request without handler names.
+func decodeRedisTask(data []byte) (*Task, error) {
+	d := &taskData{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(d); err == nil && d.URL != "" {
+		return d.task(), nil
+	}
+	req := &Request{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(req); err != nil {
+		return nil, err
+	}
+	if req.Request == nil || req.URL == nil {
+		return nil, errors.New("invalid task in redis")
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if req.Meta == nil {
+		req.Meta = map[string]interface{}{}
+	}
+	return NewTask(req), nil
+}
+
 type item struct {
 	Data interface{}
 }
@@ -57,7 +100,7 @@ func (s *Manager) SetItemPoolSize(i int) {
 }
 
 func (s *Manager) Run() {
-	s.redis.Del(s.sName + DeduplicateSuffix)
+	s.redis.Del(s.sName+DeduplicateSuffix, s.sName+FingerprintSuffix)
 	for {
 		if s.itemPool.Free() > 0 {
 			if i := s.GetItem(); i != nil {
@@ -95,15 +138,18 @@ func (s *Manager) GetItem() interface{} {
 	return item.Data
 }
 
-func (s *Manager) SendReq(req *Request) {
-	var buffer bytes.Buffer
-	ecoder := gob.NewEncoder(&buffer)
-	err := ecoder.Encode(req)
+// SendReq sends a seed request to spiders.The handlers of it are the registered handlers named by handlerNames,
+// or the handlers given to RedisDistributed if no name is given.
+// The request is encoded with its body, NotBefore and so on, which the spiders of old versions can't decode,
+// so upgrade the spiders before the Manager.
+func (s *Manager) SendReq(req *Request, handlerNames ...string) {
+	t := NewTaskByName(req, handlerNames...)
+	data, err := encodeTask(t)
 	if err != nil {
 		Log.Error(err)
 		return
 	}
-	err = s.redis.LPush(s.sName+TasksSuffix, buffer.Bytes()).Err()
+	err = pushRedisTask(s.redis, s.sName, t, data)
 	if err != nil {
 		Log.Error(err)
 	}
@@ -121,7 +167,33 @@ type RedisScheduler struct {
 func NewRedisScheduler(redis *redis.Client, sName string, bs int, fn ...CtxHandlerFun) *RedisScheduler {
 	return &RedisScheduler{redis, sName, fn, bs, NewBaseScheduler(false)}
 }
+
+// loadDelayedTask moves the delayed tasks whose time has come from the sorted set to the tasks list.
+// ZRem makes sure a task is moved by only one spider.
+func (s *RedisScheduler) loadDelayedTask() {
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	res, err := s.redis.ZRangeByScore(s.sName+DelayedSuffix, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(now, 'f', -1, 64),
+		Count: int64(s.batchSize),
+	}).Result()
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	for _, data := range res {
+		n, err := s.redis.ZRem(s.sName+DelayedSuffix, data).Result()
+		if err == nil && n > 0 {
+			err = s.redis.LPush(s.sName+TasksSuffix, data).Err()
+		}
+		if err != nil {
+			Log.Error(err)
+		}
+	}
+}
+
 func (s *RedisScheduler) loadRedisTask() {
+	s.loadDelayedTask()
 	i := 0
 	for i < s.batchSize {
 		res, err := s.redis.LPop(s.sName + TasksSuffix).Bytes()
@@ -131,10 +203,15 @@ func (s *RedisScheduler) loadRedisTask() {
 			}
 			return
 		}
-		dec := gob.NewDecoder(bytes.NewReader(res))
-		req := &Request{}
-		err = dec.Decode(req)
-		s.base.AddTask(NewTask(req, s.fn...))
+		t, err := decodeRedisTask(res)
+		if err != nil {
+			Log.Error(err)
+			continue
+		}
+		if len(t.HandlerNames) == 0 {
+			t.Handlers = s.fn
+		}
+		s.base.AddTask(t)
 		i += 1
 	}
 }
@@ -151,7 +228,21 @@ func (s *RedisScheduler) GetTask() *Task {
 func (s *RedisScheduler) GetItem() interface{} {
 	return s.base.GetItem()
 }
+
+// AddTask sends the task to redis to share with other spiders if all its handlers are registered by name,
+// otherwise the task is kept locally.
 func (s *RedisScheduler) AddTask(t *Task) {
+	if len(t.Handlers) == 0 && len(t.HandlerNames) > 0 {
+		data, err := encodeTask(t)
+		if err == nil {
+			err = pushRedisTask(s.redis, s.sName, t, data)
+		}
+		if err == nil {
+			notify(s.base.taskNotify)
+			return
+		}
+		Log.Error(err)
+	}
 	s.base.AddTask(t)
 }
 func (s *RedisScheduler) AddItem(i interface{}) {
@@ -169,29 +260,39 @@ func (s *RedisScheduler) AddItem(i interface{}) {
 		return
 	}
 }
+
+// IsTaskEmpty returns false if there are delayed tasks in redis, so the spider waits for them
 func (s *RedisScheduler) IsTaskEmpty() bool {
 	s.loadRedisTask()
-	return s.base.IsItemEmpty()
+	if !s.base.IsTaskEmpty() {
+		return false
+	}
+	n, err := s.redis.ZCard(s.sName + DelayedSuffix).Result()
+	return err != nil || n == 0
 }
 func (s *RedisScheduler) IsItemEmpty() bool {
 	l, err := s.redis.LLen(s.sName + ItemsSuffix).Result()
 	return l == 0 || err != nil
 }
 
-// ReqDeduplicate is an extension can deduplicate new task based on redis to support distributed
+// TaskNotify notifies the local tasks.Tasks from other spiders are found by polling.
+func (s *RedisScheduler) TaskNotify() <-chan struct{} {
+	return s.base.TaskNotify()
+}
+func (s *RedisScheduler) ItemNotify() <-chan struct{} {
+	return s.base.ItemNotify()
+}
+
+// RedisReqDeduplicate is an extension can deduplicate new task based on redis to support distributed.
+// The fingerprints by Spider.Fingerprinter are kept in the set sName+FingerprintSuffix.
+// They are not compatible with the hashes by GetRequestHash saved in sName+DeduplicateSuffix by the old versions,
+// so the requests seen by an old spider will be requested once more.
 func RedisReqDeduplicate(r *redis.Client, sName string) func(s *Spider) {
-	return func(s *Spider) {
-		s.OnAdd(func(ctx *Context, t *Task) *Task {
-			has := GetRequestHash(t.Request)
-			res, err := r.SAdd(sName+DeduplicateSuffix, has[:]).Result()
-			if err == nil && res == 0 {
-				return nil
-			}
-			return t
-		})
-	}
+	return Deduplicate(NewRedisSetDeduplicator(r, sName+FingerprintSuffix))
 }
 
+// RedisDistributed is an extension makes spider get tasks from and send items to redis.
+// onSeedHandler handles the requests sent by Manager.SendReq without handler names.
 func RedisDistributed(ro *redis.Options, sName string, useDeduplicate bool, onSeedHandler CtxHandlerFun) func(s *Spider) {
 	c1 := redis.NewClient(ro)
 	if pong, err := c1.Ping().Result(); pong != "PONG" || err != nil {
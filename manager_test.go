@@ -1,8 +1,12 @@
 package goribot
 
 import (
+	"bytes"
+	"encoding/gob"
 	"github.com/go-redis/redis"
+	"net/http"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -52,3 +56,91 @@ func TestManager(t *testing.T) {
 		t.Error("lost item")
 	}
 }
+
+func TestManagerHandlerNames(t *testing.T) {
+	if os.Getenv("DISABLE_SAVER_TEST") == "" {
+		return
+	}
+	ro := &redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	}
+	sName := "DistributedNamedTest"
+	m := NewManager(redis.NewClient(ro), sName)
+	m.SendReq(GetReq("https://httpbin.org/get").SetHeader("goribot", "hello world"), "seed")
+
+	var gotSeed, gotNext int64
+	s := NewSpider(
+		RedisDistributed(
+			ro,
+			sName,
+			false,
+			func(ctx *Context) {
+				t.Error("the registered handler should be used")
+			},
+		),
+	)
+	s.RegisterHandler("seed", func(ctx *Context) {
+		atomic.AddInt64(&gotSeed, 1)
+		if ctx.Resp.Json("headers.Goribot").String() != "hello world" {
+			t.Error("wrong request header")
+		}
+		ctx.AddTaskByName(GetReq("https://httpbin.org/get"), "next")
+	})
+	s.RegisterHandler("next", func(ctx *Context) {
+		atomic.AddInt64(&gotNext, 1)
+	})
+
+	go s.Run()
+	time.Sleep(10 * time.Second)
+	s.Stop()
+
+	if atomic.LoadInt64(&gotSeed) != 1 || atomic.LoadInt64(&gotNext) != 1 {
+		t.Error("lost resp", gotSeed, gotNext)
+	}
+}
+
+func TestDecodeRedisTask(t *testing.T) {
+	// the Request sent by Manager.SendReq of the old versions
+	type oldRequest struct {
+		*http.Request
+		Depth                     int
+		ResponseCharacterEncoding string
+		ProxyURL                  string
+		Meta                      map[string]interface{}
+		Err                       error
+	}
+	r, _ := http.NewRequest("GET", "http://example.com/old", nil)
+	r.Header.Set("goribot", "hello world")
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&oldRequest{Request: r, Depth: 2, ProxyURL: "http://127.0.0.1:8080", Meta: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := decodeRedisTask(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Request.URL.String() != "http://example.com/old" || task.Request.Header.Get("goribot") != "hello world" ||
+		task.Request.Depth != 2 || task.Request.ProxyURL != "http://127.0.0.1:8080" || len(task.HandlerNames) != 0 {
+		t.Error("wrong old task", task.Request)
+	}
+
+	data, err := encodeTask(NewTaskByName(PostRawReq("http://example.com/new", []byte("body")).SetDelay(time.Hour), "page"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err = decodeRedisTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Request.URL.String() != "http://example.com/new" || string(task.Request.GetBody()) != "body" ||
+		task.Request.NotBefore.IsZero() || len(task.HandlerNames) != 1 {
+		t.Error("wrong new task", task.Request)
+	}
+
+	if _, err := decodeRedisTask([]byte("not a task")); err == nil {
+		t.Error("decoded invalid task")
+	}
+}
@@ -1,10 +1,15 @@
 package goribot
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -135,3 +140,127 @@ func TestCookieJar(t *testing.T) {
 	resp, _ = d.Do(GetReq(ts.URL))
 	fmt.Println(resp.Cookies())
 }
+
+func TestBodyLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/chunked": // no Content-Length
+			w.Header().Set("Content-Type", "text/plain")
+			w.(http.Flusher).Flush()
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 100))
+	}))
+	defer ts.Close()
+
+	d := NewBaseDownloader()
+	d.MaxBodySize = 100
+	d.AllowedContentTypes = []string{"text/"}
+	if resp, err := d.Do(GetReq(ts.URL)); err != nil || len(resp.Body) != 100 {
+		t.Error("wrong response", err)
+	}
+	if _, err := d.Do(GetReq(ts.URL).SetMaxBodySize(99)); !errors.Is(err, ErrBodyTooLarge) {
+		t.Error("wrong error of large body", err)
+	}
+	if _, err := d.Do(GetReq(ts.URL + "/chunked").SetMaxBodySize(50)); !errors.Is(err, ErrBodyTooLarge) {
+		t.Error("wrong error of large chunked body", err)
+	}
+	if _, err := d.Do(GetReq(ts.URL + "/image")); !errors.Is(err, ErrContentTypeNotAllowed) {
+		t.Error("wrong error of content type", err)
+	}
+
+	s := NewSpider(Limiter(false, &LimitRule{Glob: "127.0.0.1:*", MaxBodySize: 10}))
+	var tooLarge int64
+	s.OnError(func(ctx *Context, err error) {
+		if errors.Is(err, ErrBodyTooLarge) {
+			atomic.AddInt64(&tooLarge, 1)
+		}
+	})
+	s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+		t.Error("got too large response")
+	})
+	s.Run()
+	if atomic.LoadInt64(&tooLarge) != 1 {
+		t.Error("LimitRule.MaxBodySize didn't work")
+	}
+}
+
+func TestStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		if r.URL.Query().Get("chunked") != "" {
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 100))
+	}))
+	defer ts.Close()
+
+	s := NewSpider()
+	s.Downloader.(*BaseDownloader).StreamContentTypes = []string{"image/*"}
+	var got int64
+	handler := func(ctx *Context) {
+		if ctx.Resp.BodyReader == nil || len(ctx.Resp.Body) != 0 {
+			t.Error("response is not streaming")
+			return
+		}
+		n, err := io.Copy(ioutil.Discard, ctx.Resp.BodyReader)
+		if err != nil || n != 100 {
+			t.Error("wrong streaming body", n, err)
+		}
+		atomic.AddInt64(&got, 1)
+	}
+	s.AddTask(GetReq(ts.URL).SetStream(true), handler)
+	s.AddTask(GetReq(ts.URL+"/image"), handler)
+	s.AddTask(GetReq(ts.URL+"/image?chunked=1").SetMaxBodySize(10), func(ctx *Context) {
+		if _, err := ioutil.ReadAll(ctx.Resp.BodyReader); !errors.Is(err, ErrBodyTooLarge) {
+			t.Error("wrong error of large streaming body", err)
+		}
+		atomic.AddInt64(&got, 1)
+	})
+	s.Run()
+	if atomic.LoadInt64(&got) != 3 {
+		t.Error("lost streaming response", got)
+	}
+	if st := s.Stats(); st.Bytes != 210 {
+		t.Error("wrong size of streaming bodies", st.Bytes)
+	}
+}
+
+func TestRequestGetBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer ts.Close()
+
+	for _, req := range []*Request{
+		PostRawReq(ts.URL, []byte("hello")),
+		PostReq(ts.URL, ioutil.NopCloser(strings.NewReader("hello"))), // no http.Request.GetBody
+	} {
+		if string(req.GetBody()) != "hello" || string(req.GetBody()) != "hello" {
+			t.Fatal("wrong body before sending")
+		}
+		resp, err := NewBaseDownloader().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text != "hello" {
+			t.Error("wrong sent body", resp.Text)
+		}
+		if string(req.GetBody()) != "hello" {
+			t.Error("lost body after sending", string(req.GetBody()))
+		}
+		if string(req.Clone().GetBody()) != "hello" {
+			t.Error("lost body of cloned request")
+		}
+	}
+	if len(GetReq(ts.URL).GetBody()) != 0 {
+		t.Error("wrong body of get request")
+	}
+}
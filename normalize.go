@@ -0,0 +1,336 @@
+package goribot
+
+import (
+	"github.com/gobwas/glob"
+	"golang.org/x/net/idna"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultPorts are the ports removed from urls of schemes
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"ftp":   "21",
+}
+
+// NormalizeRule is the extra normalization for urls of matched hosts
+type NormalizeRule struct {
+	// Glob is the glob pattern of normalized host like "*.example.com"
+	Glob string
+	// RemoveParams are the patterns of params removed besides URLNormalizer.RemoveParams
+	RemoveParams []string
+	// KeepParams are the patterns of the only params kept if it's not empty
+	KeepParams []string
+	// RemoveWWW removes the "www." prefix of host
+	RemoveWWW bool
+	// ForceHTTPS changes the scheme from http to https
+	ForceHTTPS bool
+	// LowercasePath lowercases the path for case-insensitive sites
+	LowercasePath bool
+	// RemoveTrailingSlash makes "/a/" the same as "/a"
+	RemoveTrailingSlash bool
+
+	compiledGlob glob.Glob
+}
+
+// URLNormalizer rewrites the different spellings of a url to the same one.
+// It lowercases scheme and host, converts international domain names to punycode, removes default port,
+// normalizes percent-encoding, resolves dot-segments like "/a/../b", and removes the params and fragment as configured.
+type URLNormalizer struct {
+	// RemoveParams are the case-insensitive patterns of query and path params removed like "utm_*", see path.Match
+	RemoveParams []string
+	// RemoveFragment removes the "#fragment" of url
+	RemoveFragment bool
+	// RemoveTrailingSlash makes "/a/" the same as "/a"
+	RemoveTrailingSlash bool
+	// SortQuery sorts the query params by name and value
+	SortQuery bool
+
+	rules []*NormalizeRule
+}
+
+// NewURLNormalizer creates a URLNormalizer removing DefaultIgnoreParams and fragment and sorting query params,
+// with the per host rules. The first matched rule is used.
+func NewURLNormalizer(rules ...*NormalizeRule) *URLNormalizer {
+	for _, r := range rules {
+		r.compiledGlob = glob.MustCompile(strings.ToLower(r.Glob))
+	}
+	return &URLNormalizer{
+		RemoveParams:   DefaultIgnoreParams,
+		RemoveFragment: true,
+		SortQuery:      true,
+		rules:          rules,
+	}
+}
+
+// DefaultNormalizer is the URLNormalizer used by DefaultFingerprinter
+var DefaultNormalizer = NewURLNormalizer()
+
+// NormalizeURL normalizes the url string by DefaultNormalizer
+func NormalizeURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return DefaultNormalizer.Normalize(u).String(), nil
+}
+
+// NormalizeHost returns the lowercase and punycode host of u without default port, used to match hosts
+func NormalizeHost(u *url.URL) string {
+	host, port := strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), u.Port()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	} else if a, err := idna.Lookup.ToASCII(host); err == nil {
+		host = a
+	}
+	if port != "" && port != defaultPorts[strings.ToLower(u.Scheme)] {
+		host += ":" + port
+	}
+	return host
+}
+
+// rule returns the rule matching host
+func (n *URLNormalizer) rule(host string) *NormalizeRule {
+	for _, r := range n.rules {
+		if r.compiledGlob.Match(host) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Normalize returns the normalized copy of u
+func (n *URLNormalizer) Normalize(u *url.URL) *url.URL {
+	res := *u
+	if u.User != nil {
+		user := *u.User
+		res.User = &user
+	}
+	res.Scheme = strings.ToLower(u.Scheme)
+	if res.Opaque != "" {
+		return &res
+	}
+	res.Host = NormalizeHost(u)
+	r := n.rule(res.Host)
+	if r != nil {
+		if r.RemoveWWW && strings.HasPrefix(res.Host, "www.") {
+			res.Host = strings.TrimPrefix(res.Host, "www.")
+		}
+		if r.ForceHTTPS && res.Scheme == "http" {
+			res.Scheme = "https"
+		}
+	}
+	remove := func(name string) bool {
+		if matchParam(n.RemoveParams, name) {
+			return true
+		}
+		if r != nil {
+			return matchParam(r.RemoveParams, name) || (len(r.KeepParams) > 0 && !matchParam(r.KeepParams, name))
+		}
+		return false
+	}
+
+	p := normalizePath(u.EscapedPath(), remove)
+	if r != nil && r.LowercasePath {
+		p = lowerPath(p)
+	}
+	if (n.RemoveTrailingSlash || (r != nil && r.RemoveTrailingSlash)) && len(p) > 1 {
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" && res.Host != "" {
+		p = "/"
+	}
+	res.RawPath = p
+	if res.Path, _ = url.PathUnescape(p); res.Path == p {
+		res.RawPath = ""
+	}
+
+	res.RawQuery = normalizeQuery(u.RawQuery, remove, n.SortQuery)
+	res.ForceQuery = false
+	if n.RemoveFragment {
+		res.Fragment = ""
+	}
+	return &res
+}
+
+// matchParam reports whether the param name matches one of the patterns case-insensitively
+func matchParam(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if ok, err := path.Match(p, name); ok || (err != nil && p == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePath normalizes the percent-encoding of escaped path, removes its dot-segments
+// and path params like ";jsessionid=xxx" matching remove.
+func normalizePath(p string, remove func(name string) bool) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		params := strings.Split(seg, ";")
+		kept := []string{params[0]}
+		for _, param := range params[1:] {
+			if !remove(strings.SplitN(param, "=", 2)[0]) {
+				kept = append(kept, param)
+			}
+		}
+		segments[i] = normalizePercent(strings.Join(kept, ";"))
+	}
+	return removeDotSegments(strings.Join(segments, "/"))
+}
+
+// removeDotSegments resolves the "." and ".." segments of an absolute path by RFC 3986
+func removeDotSegments(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	res := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+		case "..":
+			if len(res) > 1 {
+				res = res[:len(res)-1]
+			}
+		default:
+			res = append(res, seg)
+			continue
+		}
+		if last { // "/a/." and "/a/b/.." are directories
+			res = append(res, "")
+		}
+	}
+	return strings.Join(res, "/")
+}
+
+// lowerPath lowercases the path except the percent-encodings
+func lowerPath(p string) string {
+	b := []byte(p)
+	for i := 0; i < len(b); i++ {
+		if b[i] == '%' {
+			i += 2
+			continue
+		}
+		if 'A' <= b[i] && b[i] <= 'Z' {
+			b[i] += 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// normalizeQuery unescapes and escapes the params again without the ones matching remove,
+// and sorts them by name and value if sorting is true.
+func normalizeQuery(raw string, remove func(name string) bool, sorting bool) string {
+	type param struct{ k, v, raw string }
+	var params []param
+	for _, s := range strings.Split(raw, "&") {
+		if s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		k, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			kv[0] = normalizePercent(kv[0])
+			k = kv[0]
+		} else {
+			kv[0] = url.QueryEscape(k)
+		}
+		if remove(k) {
+			continue
+		}
+		p := param{k: k}
+		if len(kv) == 2 {
+			if p.v, err = url.QueryUnescape(kv[1]); err != nil {
+				kv[1] = normalizePercent(kv[1])
+				p.v = kv[1]
+			} else {
+				kv[1] = url.QueryEscape(p.v)
+			}
+		}
+		p.raw = strings.Join(kv, "=")
+		params = append(params, p)
+	}
+	if sorting {
+		sort.SliceStable(params, func(i, j int) bool {
+			if params[i].k != params[j].k {
+				return params[i].k < params[j].k
+			}
+			return params[i].v < params[j].v
+		})
+	}
+	res := make([]string, len(params))
+	for i, p := range params {
+		res[i] = p.raw
+	}
+	return strings.Join(res, "&")
+}
+
+// normalizePercent decodes the percent-encoded unreserved characters and uppercases the other escapes
+func normalizePercent(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(c) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(strings.ToUpper(s[i : i+3]))
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// isUnreserved reports whether c is an unreserved character of RFC 3986
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// UseURLNormalizer is an extension normalizes the urls of new tasks by n, so the other extensions and
+// the sent requests use the normalized urls. Use it before the other extensions handling new tasks.
+// The Host of request follows the normalized url unless it's set to another host.
+func UseURLNormalizer(n *URLNormalizer) func(s *Spider) {
+	return func(s *Spider) {
+		s.OnAdd(func(ctx *Context, t *Task) *Task {
+			if t.Request.Err == nil && t.Request.URL != nil && t.Request.URL.IsAbs() {
+				old := t.Request.URL.Host
+				t.Request.URL = n.Normalize(t.Request.URL)
+				if t.Request.Host == "" || t.Request.Host == old {
+					t.Request.Host = t.Request.URL.Host
+				}
+			}
+			return t
+		})
+	}
+}
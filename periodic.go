@@ -0,0 +1,231 @@
+package goribot
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule decides the times of periodic tasks
+type Schedule interface {
+	// Next returns the next time after t
+	Next(t time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// Every returns a Schedule runs every d
+func Every(d time.Duration) Schedule {
+	if d <= 0 {
+		panic("interval of Every must be positive")
+	}
+	return everySchedule(d)
+}
+
+// CronSchedule is a Schedule of a cron expression
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny or dowAny is true if the field is "*", day matches either dom or dow if neither is "*"
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+// Cron parses a standard cron expression with five fields: minute, hour, day of month, month and day of week,
+// like "*/5 * * * *" or "0 8 * * 1-5". Fields support "*", lists, ranges and steps.
+// The times are in local time zone.
+func Cron(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q should have 5 fields", spec)
+	}
+	s := &CronSchedule{loc: time.Local}
+	var err error
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	targets := [5]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range fields {
+		if *targets[i], err = parseCronField(f, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", spec, err)
+		}
+	}
+	if s.dow&(1<<7) != 0 { // 7 is sunday too
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+// MustCron is like Cron but panics if the expression is invalid
+func MustCron(spec string) *CronSchedule {
+	s, err := Cron(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// parseCronField parses a field to a bit set
+func parseCronField(f string, min, max int) (uint64, error) {
+	var res uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range [%d,%d]", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+	return res, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the next time after t matching the expression, zero if there is none in five years
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Periodic is an extension adds a copy of req with handlers at start and then at every time of schedule,
+// so the spider keeps crawling until it's stopped. It sets Spider.AutoStop to false.
+// The periodic tasks have Meta["Periodic"] and they are not dropped by ReqDeduplicate.
+func Periodic(schedule Schedule, req *Request, handlers ...CtxHandlerFun) func(s *Spider) {
+	return periodic(schedule, req, func(r *Request) *Task { return NewTask(r, handlers...) })
+}
+
+// PeriodicByName is like Periodic with the names of handlers registered by Spider.RegisterHandler
+func PeriodicByName(schedule Schedule, req *Request, names ...string) func(s *Spider) {
+	return periodic(schedule, req, func(r *Request) *Task { return NewTaskByName(r, names...) })
+}
+
+func periodic(schedule Schedule, req *Request, newTask func(r *Request) *Task) func(s *Spider) {
+	return func(s *Spider) {
+		s.AutoStop = false
+		done := make(chan struct{})
+		add := func() {
+			r := req.Clone()
+			r.Meta["Periodic"] = true
+			s.addTask(newTask(r))
+		}
+		s.OnStart(func(s *Spider) {
+			add()
+			go func() {
+				for next := schedule.Next(time.Now()); !next.IsZero(); next = schedule.Next(time.Now()) {
+					timer := time.NewTimer(time.Until(next))
+					select {
+					case <-timer.C:
+						add()
+					case <-done:
+						timer.Stop()
+						return
+					}
+				}
+			}()
+		})
+		s.OnFinish(func(s *Spider) {
+			close(done)
+		})
+	}
+}
+
+// ReqDeduplicateTTL is an extension deduplicates new tasks like ReqDeduplicate,
+// but a request could be sent again after ttl since it was added last time.
+func ReqDeduplicateTTL(ttl time.Duration) func(s *Spider) {
+	return Deduplicate(NewMemoryDeduplicator(ttl))
+}
+
+// ChangeDetection is an extension skips the handlers of responses whose content didn't change
+// since the last fetch of the same url, so no items or tasks are created from them.
+// selector is the css selector of the compared content of html, empty means the whole body.
+// ctx.Meta["ContentChanged"] is set to whether the content changed.
+func ChangeDetection(selector string) func(s *Spider) {
+	lock := sync.Mutex{}
+	hashes := map[string][sha256.Size]byte{}
+	return func(s *Spider) {
+		s.OnResp(func(ctx *Context) {
+			if ctx.Resp.BodyReader != nil {
+				return
+			}
+			var h [sha256.Size]byte
+			if selector != "" && ctx.Resp.Dom != nil {
+				content, err := ctx.Resp.Dom.Find(selector).Html()
+				if err != nil {
+					return
+				}
+				h = sha256.Sum256([]byte(content))
+			} else {
+				h = sha256.Sum256(ctx.Resp.Body)
+			}
+			key := ctx.Req.URL.String()
+
+			lock.Lock()
+			last, ok := hashes[key]
+			hashes[key] = h
+			lock.Unlock()
+
+			changed := !ok || last != h
+			ctx.Meta["ContentChanged"] = changed
+			if !changed {
+				Log.Info("Content of", key, "didn't change, skip it")
+				ctx.Abort()
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package goribot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	loc := time.Local
+	for _, c := range []struct {
+		spec      string
+		from, now time.Time
+	}{
+		{"*/5 * * * *", time.Date(2020, 1, 1, 10, 3, 20, 0, loc), time.Date(2020, 1, 1, 10, 5, 0, 0, loc)},
+		{"0 8 * * 1-5", time.Date(2020, 1, 3, 9, 0, 0, 0, loc), time.Date(2020, 1, 6, 8, 0, 0, 0, loc)}, // friday to monday
+		{"30 23 31 12 *", time.Date(2020, 1, 1, 0, 0, 0, 0, loc), time.Date(2020, 12, 31, 23, 30, 0, 0, loc)},
+		{"0 0 1 * 0", time.Date(2020, 1, 2, 0, 0, 0, 0, loc), time.Date(2020, 1, 5, 0, 0, 0, 0, loc)}, // 1st or sunday
+		{"0 0 29 2 *", time.Date(2021, 1, 1, 0, 0, 0, 0, loc), time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+		{"15,45 1 * * 7", time.Date(2020, 1, 5, 1, 20, 0, 0, loc), time.Date(2020, 1, 5, 1, 45, 0, 0, loc)},
+	} {
+		if next := MustCron(c.spec).Next(c.from); !next.Equal(c.now) {
+			t.Error("wrong next time of", c.spec, next)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := Cron(spec); err == nil {
+			t.Error("invalid cron expression is accepted", spec)
+		}
+	}
+	if next := MustCron("0 0 30 2 *").Next(time.Now()); !next.IsZero() {
+		t.Error("impossible expression should never run", next)
+	}
+}
+
+func TestPeriodic(t *testing.T) {
+	var requests, version int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprintf(w, `<html><body><p>%d</p><span>%d</span></body></html>`, atomic.LoadInt64(&version), time.Now().UnixNano())
+	}))
+	defer ts.Close()
+
+	var handled, items int64
+	s := NewSpider(
+		ReqDeduplicate(),
+		ReqDeduplicateTTL(time.Hour),
+		ChangeDetection("p"),
+		Periodic(Every(50*time.Millisecond), Get(ts.URL+"/list"), func(ctx *Context) {
+			n := atomic.AddInt64(&handled, 1)
+			ctx.AddItem(n)
+			ctx.AddTask(Get(ts.URL+"/article"), func(ctx *Context) {})
+			if n == 2 {
+				ctx.AddTask(Get(ts.URL + "/article").SetDelay(time.Hour)) // dropped by deduplicate
+			}
+		}),
+	)
+	s.OnItem(func(i interface{}) interface{} {
+		atomic.AddInt64(&items, 1)
+		return i
+	})
+	go func() {
+		time.Sleep(180 * time.Millisecond)
+		atomic.StoreInt64(&version, 1)
+		time.Sleep(180 * time.Millisecond)
+		s.Stop()
+	}()
+	s.Run()
+	// the list page is requested about 8 times, but its content only changes once
+	if r := atomic.LoadInt64(&requests); r < 5 {
+		t.Error("periodic task isn't added", r)
+	}
+	if atomic.LoadInt64(&handled) != 2 || atomic.LoadInt64(&items) != 2 {
+		t.Error("unchanged content isn't skipped", handled, items)
+	}
+	if s.Stats().Deduplicated != 2 {
+		t.Error("wrong deduplicated requests", s.Stats().Deduplicated)
+	}
+}
+
+func TestReqDeduplicateTTL(t *testing.T) {
+	s := NewSpider(ReqDeduplicateTTL(100 * time.Millisecond))
+	added := func() bool {
+		return s.handleOnAdd(nil, NewTask(Get("http://example.com/"))) != nil
+	}
+	if !added() || added() {
+		t.Error("request isn't deduplicated")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !added() {
+		t.Error("request isn't expired")
+	}
+	if added() {
+		t.Error("request isn't deduplicated again")
+	}
+	if s.handleOnAdd(nil, NewTask(Get("http://example.com/").WithMeta("Periodic", true))) == nil {
+		t.Error("periodic request is deduplicated")
+	}
+}
@@ -0,0 +1,612 @@
+package goribot
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	// the markers of Meta set by users or the old versions
+	gob.Register(struct{}{})
+}
+
+// taskData is the serializable form of Task.Only the handlers referred by HandlerNames could be kept.
+type taskData struct {
+	Method                    string
+	URL                       string
+	Header                    http.Header
+	Body                      []byte
+	Depth                     int
+	Priority                  int
+	ResponseCharacterEncoding string
+	ProxyURL                  string
+	MaxBodySize               int64
+	Stream                    bool
+	TransportConfig           *transportData
+	NotBefore                 time.Time
+	Meta                      map[string]interface{}
+	HandlerNames              []string
+}
+
+func newTaskData(t *Task) *taskData {
+	req := t.Request
+	if req.Request == nil {
+		return nil
+	}
+	d := &taskData{
+		Method:                    req.Method,
+		URL:                       req.URL.String(),
+		Header:                    req.Header,
+		Body:                      req.GetBody(),
+		Depth:                     req.Depth,
+		Priority:                  req.Priority,
+		ResponseCharacterEncoding: req.ResponseCharacterEncoding,
+		ProxyURL:                  req.ProxyURL,
+		MaxBodySize:               req.MaxBodySize,
+		Stream:                    req.Stream,
+		NotBefore:                 req.NotBefore,
+		Meta:                      req.Meta,
+		HandlerNames:              t.HandlerNames,
+	}
+	if c := req.TransportConfig; c != nil {
+		d.TransportConfig = &transportData{
+			ConnectTimeout:        c.ConnectTimeout,
+			TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+			Timeout:               c.Timeout,
+			StreamIdleTimeout:     c.StreamIdleTimeout,
+			MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+			DisableHTTP2:          c.DisableHTTP2,
+		}
+	}
+	return d
+}
+
+// transportData is the serializable form of TransportConfig without TLSConfig
+type transportData struct {
+	ConnectTimeout, TLSHandshakeTimeout, ResponseHeaderTimeout, Timeout, StreamIdleTimeout time.Duration
+	MaxIdleConnsPerHost                                                                    int
+	DisableHTTP2                                                                           bool
+}
+
+func (d *taskData) task() *Task {
+	var body io.Reader
+	if len(d.Body) > 0 {
+		body = bytes.NewReader(d.Body)
+	}
+	r, err := http.NewRequest(d.Method, d.URL, body)
+	if err == nil && d.Header != nil {
+		r.Header = d.Header
+	}
+	req := &Request{
+		Request:                   r,
+		Depth:                     d.Depth,
+		Priority:                  d.Priority,
+		ResponseCharacterEncoding: d.ResponseCharacterEncoding,
+		ProxyURL:                  d.ProxyURL,
+		MaxBodySize:               d.MaxBodySize,
+		Stream:                    d.Stream,
+		NotBefore:                 d.NotBefore,
+		Meta:                      d.Meta,
+		Err:                       err,
+	}
+	if req.Meta == nil {
+		req.Meta = map[string]interface{}{}
+	}
+	if c := d.TransportConfig; c != nil {
+		req.TransportConfig = &TransportConfig{
+			ConnectTimeout:        c.ConnectTimeout,
+			TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+			Timeout:               c.Timeout,
+			StreamIdleTimeout:     c.StreamIdleTimeout,
+			MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+			DisableHTTP2:          c.DisableHTTP2,
+		}
+	}
+	return NewTaskByName(req, d.HandlerNames...)
+}
+
+// encodeTask encodes the task by gob
+func encodeTask(t *Task) ([]byte, error) {
+	d := newTaskData(t)
+	if d == nil {
+		return nil, t.Request.Err
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(d); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeTask decodes a task encoded by encodeTask
+func decodeTask(data []byte) (*Task, error) {
+	d := &taskData{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(d); err != nil {
+		return nil, err
+	}
+	return d.task(), nil
+}
+
+const (
+	diskAddTask uint8 = iota + 1
+	diskTakeTask
+	diskDoneTask
+	diskAddItem
+	diskDoneItem
+	diskSeen
+)
+
+// diskRecord is an entry of the DiskScheduler log
+type diskRecord struct {
+	Op    uint8
+	ID    uint64
+	Front bool
+	Task  *taskData
+	Item  *item
+	Hash  []byte
+}
+
+type diskEntry struct {
+	id    uint64
+	task  *Task
+	item  interface{}
+	saved bool
+}
+
+// DiskScheduler is a Scheduler keeps tasks, items and request hashes in an append-only log file,
+// so a crawl could be resumed after the program restarts.
+// Tasks and items which were got but not done last time will be handled again,
+// including the tasks cancelled by shutdown or failed without being retried.
+//
+// The log is compacted only when it's opened by NewDiskScheduler, and the request hashes for Seen are kept in memory,
+// so a very long crawl grows the log and memory until it's restarted.
+// Use a Deduplicator like BloomDeduplicator with PersistDeduplicator instead of Seen for lots of requests.
+//
+// Handlers of tasks must be registered by Spider.RegisterHandler and referred by Task.HandlerNames,
+// and items and the values of Meta must be registered by gob.Register, or they could not be persisted.
+// The failures of persisting are reported by Err and Close.
+type DiskScheduler struct {
+	// DepthFirst sets push new tasks to the top of the queue
+	DepthFirst bool
+
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	nextID  uint64
+	tasks   *list.List
+	delayed delayQueue
+	items   *list.List
+	running map[*Task]*diskEntry
+	// runningItems are the items got but not done
+	runningItems []*diskEntry
+	seen         map[[md5.Size]byte]struct{}
+	warnOnce     sync.Once
+	failures     int
+	err          error
+
+	taskNotify, itemNotify chan struct{}
+}
+
+// NewDiskScheduler opens or creates the scheduler log in dir and loads the state left by the last run
+func NewDiskScheduler(dir string, depthFirst bool) (*DiskScheduler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &DiskScheduler{
+		DepthFirst: depthFirst,
+		path:       filepath.Join(dir, "scheduler.log"),
+		nextID:     1,
+		tasks:      list.New(),
+		items:      list.New(),
+		running:    map[*Task]*diskEntry{},
+		seen:       map[[md5.Size]byte]struct{}{},
+		taskNotify: make(chan struct{}, 1),
+		itemNotify: make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	return s, nil
+}
+
+// load replays the log file
+func (s *DiskScheduler) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tasks, items := map[uint64]*list.Element{}, map[uint64]*list.Element{}
+	running := map[uint64]*diskEntry{}
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readDiskRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Log.Warning("broken record at the end of scheduler log, ignored:", err)
+			break
+		}
+		if rec.ID >= s.nextID {
+			s.nextID = rec.ID + 1
+		}
+		switch rec.Op {
+		case diskAddTask:
+			if rec.Task == nil {
+				continue
+			}
+			e := &diskEntry{id: rec.ID, task: rec.Task.task(), saved: true}
+			if rec.Front {
+				tasks[rec.ID] = s.tasks.PushFront(e)
+			} else {
+				tasks[rec.ID] = s.tasks.PushBack(e)
+			}
+		case diskTakeTask:
+			if el, ok := tasks[rec.ID]; ok {
+				running[rec.ID] = s.tasks.Remove(el).(*diskEntry)
+				delete(tasks, rec.ID)
+			}
+		case diskDoneTask:
+			delete(running, rec.ID)
+		case diskAddItem:
+			if rec.Item == nil {
+				continue
+			}
+			items[rec.ID] = s.items.PushBack(&diskEntry{id: rec.ID, item: rec.Item.Data, saved: true})
+		case diskDoneItem:
+			if el, ok := items[rec.ID]; ok {
+				s.items.Remove(el)
+				delete(items, rec.ID)
+			}
+		case diskSeen:
+			var h [md5.Size]byte
+			copy(h[:], rec.Hash)
+			s.seen[h] = struct{}{}
+		}
+	}
+	// handle the unfinished tasks first
+	var ids []uint64
+	for id := range running {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i := len(ids) - 1; i >= 0; i-- {
+		s.tasks.PushFront(running[ids[i]])
+	}
+	// the tasks waiting for NotBefore
+	now := time.Now()
+	for el := s.tasks.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*diskEntry); isDelayed(e.task, now) {
+			s.tasks.Remove(el)
+			s.delayed.push(e.task.Request.NotBefore, e)
+		}
+		el = next
+	}
+	return nil
+}
+
+// compact rewrites the log file with only the current state
+func (s *DiskScheduler) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = func() error {
+		for h := range s.seen {
+			h := h
+			if err := writeDiskRecord(w, &diskRecord{Op: diskSeen, Hash: h[:]}); err != nil {
+				return err
+			}
+		}
+		var entries []*diskEntry
+		for el := s.tasks.Front(); el != nil; el = el.Next() {
+			entries = append(entries, el.Value.(*diskEntry))
+		}
+		for _, v := range s.delayed.values {
+			entries = append(entries, v.value.(*diskEntry))
+		}
+		for _, e := range entries {
+			d := newTaskData(e.task)
+			if d == nil {
+				continue
+			}
+			if err := writeDiskRecord(w, &diskRecord{Op: diskAddTask, ID: e.id, Task: d}); err != nil {
+				return err
+			}
+		}
+		for el := s.items.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*diskEntry)
+			if err := writeDiskRecord(w, &diskRecord{Op: diskAddItem, ID: e.id, Item: &item{Data: e.item}}); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// write appends a record to the log, returns false if the record could not be persisted
+func (s *DiskScheduler) write(rec *diskRecord) bool {
+	if s.w == nil {
+		return false
+	}
+	err := writeDiskRecord(s.w, rec)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		Log.Error("write scheduler log error", err)
+		s.failures += 1
+		if s.err == nil {
+			s.err = err
+		}
+		return false
+	}
+	return true
+}
+
+// Err returns the number of records failed to be persisted and the first error of them
+func (s *DiskScheduler) Err() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failures, s.err
+}
+
+func (s *DiskScheduler) GetTask() *Task {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for {
+		e, ok := s.delayed.pop(now)
+		if !ok {
+			break
+		}
+		s.pushEntry(e.(*diskEntry))
+	}
+	el := s.tasks.Front()
+	if el == nil {
+		return nil
+	}
+	e := s.tasks.Remove(el).(*diskEntry)
+	if e.saved {
+		s.write(&diskRecord{Op: diskTakeTask, ID: e.id})
+	}
+	s.running[e.task] = e
+	return e.task
+}
+
+func (s *DiskScheduler) GetItem() interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	el := s.items.Front()
+	if el == nil {
+		return nil
+	}
+	e := s.items.Remove(el).(*diskEntry)
+	s.runningItems = append(s.runningItems, e)
+	return e.item
+}
+
+// ItemDone marks the item is handled, so it won't be loaded again.
+// The items are compared by reflect.DeepEqual, it doesn't matter which one of the equal items is marked.
+func (s *DiskScheduler) ItemDone(i interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, e := range s.runningItems {
+		if reflect.DeepEqual(e.item, i) {
+			s.runningItems = append(s.runningItems[:k], s.runningItems[k+1:]...)
+			if e.saved {
+				s.write(&diskRecord{Op: diskDoneItem, ID: e.id})
+			}
+			return
+		}
+	}
+}
+
+func (s *DiskScheduler) AddTask(t *Task) {
+	if len(t.Handlers) > 0 {
+		s.warnOnce.Do(func() {
+			Log.Warning("DiskScheduler could not persist handlers of tasks, use Spider.RegisterHandler and AddTaskByName instead")
+		})
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := &diskEntry{id: s.nextID, task: t}
+	s.nextID += 1
+	if d := newTaskData(t); d != nil {
+		e.saved = s.write(&diskRecord{Op: diskAddTask, ID: e.id, Front: s.DepthFirst, Task: d})
+	}
+	if isDelayed(t, time.Now()) {
+		s.delayed.push(t.Request.NotBefore, e)
+	} else {
+		s.pushEntry(e)
+	}
+	notify(s.taskNotify)
+}
+
+func (s *DiskScheduler) pushEntry(e *diskEntry) {
+	if s.DepthFirst {
+		s.tasks.PushFront(e)
+	} else {
+		s.tasks.PushBack(e)
+	}
+}
+
+func (s *DiskScheduler) AddItem(i interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := &diskEntry{id: s.nextID, item: i}
+	s.nextID += 1
+	e.saved = s.write(&diskRecord{Op: diskAddItem, ID: e.id, Item: &item{Data: i}})
+	s.items.PushBack(e)
+	notify(s.itemNotify)
+}
+
+// TaskDone marks the task is handled, so it won't be loaded again
+func (s *DiskScheduler) TaskDone(t *Task) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.running[t]; ok {
+		delete(s.running, t)
+		if e.saved {
+			s.write(&diskRecord{Op: diskDoneTask, ID: e.id})
+		}
+	}
+}
+
+// Seen reports whether the request hash has been seen before, and marks it as seen.
+func (s *DiskScheduler) Seen(h [md5.Size]byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.seen[h]; ok {
+		return true
+	}
+	s.seen[h] = struct{}{}
+	s.write(&diskRecord{Op: diskSeen, Hash: h[:]})
+	return false
+}
+
+func (s *DiskScheduler) IsTaskEmpty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tasks.Len() == 0 && s.delayed.Len() == 0
+}
+
+func (s *DiskScheduler) NextTaskTime() (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tasks.Len() > 0 {
+		return time.Time{}, false
+	}
+	return s.delayed.next()
+}
+
+func (s *DiskScheduler) IsItemEmpty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.items.Len() == 0
+}
+
+func (s *DiskScheduler) TaskNotify() <-chan struct{} {
+	return s.taskNotify
+}
+
+func (s *DiskScheduler) ItemNotify() <-chan struct{} {
+	return s.itemNotify
+}
+
+// Close flushes and closes the log file.The scheduler only keeps working in memory after closed.
+func (s *DiskScheduler) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file, s.w = nil, nil
+	if err == nil && s.err != nil {
+		err = fmt.Errorf("%d records of scheduler log are not persisted: %w", s.failures, s.err)
+	}
+	return err
+}
+
+// writeDiskRecord writes a gob encoded record with a length prefix
+func writeDiskRecord(w io.Writer, rec *diskRecord) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(rec); err != nil {
+		return err
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(buffer.Len()))
+	if _, err := w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+func readDiskRecord(r io.Reader) (*diskRecord, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rec := &diskRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// DiskPersistent is an extension replaces the Scheduler with a DiskScheduler stored in dir,
+// so the crawl could be stopped and resumed later. If useDeduplicate is true, the new tasks are
+// deduplicated like ReqDeduplicate and the request hashes are persisted as well,
+// which also drops the seed tasks added again after restart.
+func DiskPersistent(dir string, depthFirst, useDeduplicate bool) func(s *Spider) {
+	d, err := NewDiskScheduler(dir, depthFirst)
+	if err != nil {
+		panic(err)
+	}
+	return func(s *Spider) {
+		s.Scheduler = d
+		if useDeduplicate {
+			s.Use(Deduplicate(d))
+		}
+		s.OnFinish(func(s *Spider) {
+			if err := d.Close(); err != nil {
+				Log.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package goribot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskScheduler(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.AddTask(NewTaskByName(
+			PostRawReq(fmt.Sprint("http://example.com/", i), []byte("hello")).
+				SetHeader("Goribot", "hello world").
+				WithMeta("i", i),
+			"page",
+		))
+	}
+	s.AddItem("item 1")
+	s.AddItem("item 2")
+	h := GetRequestHash(GetReq("http://example.com/"))
+	if s.Seen(h) {
+		t.Error("wrong deduplicate result")
+	}
+	s.AddTask(NewTaskByName(GetReq("http://example.com/later").SetDelay(time.Hour), "page"))
+	first := s.GetTask() // taken but not done
+	s.TaskDone(s.GetTask())
+	if s.GetItem() != "item 1" {
+		t.Error("wrong item")
+	}
+	s.ItemDone("item 1")
+	if s.GetItem() != "item 2" { // not done, it's loaded again
+		t.Error("wrong item")
+	}
+	if first.Request.Meta["i"] != 0 {
+		t.Error("wrong task order")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewDiskScheduler(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, i := range []int{0, 2} {
+		task := s.GetTask()
+		if task == nil {
+			t.Fatal("lost task", i)
+		}
+		if task.Request.Meta["i"] != i {
+			t.Error("wrong task", task.Request.Meta["i"], "expected", i)
+		}
+		if task.Request.URL.String() != fmt.Sprint("http://example.com/", i) ||
+			task.Request.Method != "POST" ||
+			task.Request.Header.Get("Goribot") != "hello world" ||
+			string(task.Request.GetBody()) != "hello" ||
+			len(task.HandlerNames) != 1 || task.HandlerNames[0] != "page" {
+			t.Error("wrong task data", task.Request, task.HandlerNames)
+		}
+		s.TaskDone(task)
+	}
+	if s.GetTask() != nil || s.IsTaskEmpty() {
+		t.Error("lost delayed task")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewDiskScheduler(dir, false) // compacted with the delayed task
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.delayed.Len() != 1 || s.GetTask() != nil || s.IsTaskEmpty() {
+		t.Error("lost delayed task after reloading")
+	}
+	if s.GetItem() != "item 2" || !s.IsItemEmpty() {
+		t.Error("wrong items")
+	}
+	if !s.Seen(h) {
+		t.Error("lost request hash")
+	}
+}
+
+func TestDiskSchedulerMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSpider(RandomUserAgent())
+	req := s.handleOnReq(nil, GetReq("http://example.com/ua"))
+	d, err := NewDiskScheduler(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddTask(NewTaskByName(req, "page"))
+	d.AddTask(NewTaskByName(GetReq("http://example.com/marker").WithMeta("Marker", struct{}{}), "page"))
+	type unregistered struct{ A int }
+	d.AddTask(NewTaskByName(GetReq("http://example.com/lost").WithMeta("Lost", unregistered{1}), "page"))
+	if n, err := d.Err(); n != 1 || err == nil {
+		t.Error("persisting failure isn't reported", n, err)
+	}
+	if err := d.Close(); err == nil {
+		t.Error("persisting failure isn't returned by Close")
+	}
+
+	d, err = NewDiskScheduler(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	task := d.GetTask()
+	if task == nil || task.Request.URL.Path != "/ua" || task.Request.Meta["RandomUserAgent"] != true || task.Request.Header.Get("User-Agent") == "" {
+		t.Fatal("lost task with RandomUserAgent marker", task)
+	}
+	task = d.GetTask()
+	if task == nil || task.Request.URL.Path != "/marker" || task.Request.Meta["Marker"] != struct{}{} {
+		t.Fatal("lost task with marker", task)
+	}
+	if d.GetTask() != nil {
+		t.Error("the task could not be persisted is loaded")
+	}
+	if n, err := d.Err(); n != 0 || err != nil {
+		t.Error("wrong persisting failures", n, err)
+	}
+}
+
+func TestDiskPersistent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first spider exits before running
+	s := NewSpider(DiskPersistent(dir, false, true))
+	s.AddTaskByName(GetReq(ts.URL), "seed")
+	if err := s.Scheduler.(*DiskScheduler).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got int64
+	s = NewSpider(DiskPersistent(dir, false, true))
+	s.RegisterHandler("seed", func(ctx *Context) {
+		atomic.AddInt64(&got, 1)
+		ctx.AddTaskByName(GetReq(ts.URL+"/next"), "next")
+	})
+	s.RegisterHandler("next", func(ctx *Context) {
+		atomic.AddInt64(&got, 1)
+	})
+	s.AddTaskByName(GetReq(ts.URL), "seed") // dropped by the persisted request hash
+	s.Run()
+	if atomic.LoadInt64(&got) != 2 {
+		t.Error("wrong handled tasks", got)
+	}
+}
+
+func TestDiskPersistentUnfinished(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ok, failed int64
+	run := func() {
+		s := NewSpider(DiskPersistent(dir, false, false))
+		s.RegisterHandler("page", func(ctx *Context) {
+			atomic.AddInt64(&ok, 1)
+		})
+		s.OnError(func(ctx *Context, err error) {
+			atomic.AddInt64(&failed, 1)
+		})
+		s.Run()
+	}
+	s := NewSpider(DiskPersistent(dir, false, false))
+	s.AddTaskByName(GetReq(ts.URL), "page")
+	s.AddTaskByName(GetReq("http://127.0.0.1:0/"), "page") // fails without retrying
+	if err := s.Scheduler.(*DiskScheduler).Close(); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if atomic.LoadInt64(&ok) != 1 || atomic.LoadInt64(&failed) != 1 {
+		t.Fatal("wrong first run", ok, failed)
+	}
+	run()
+	if atomic.LoadInt64(&ok) != 1 || atomic.LoadInt64(&failed) != 2 {
+		t.Error("failed task isn't handled again", ok, failed)
+	}
+
+	// the retried task is done, the retry is kept instead
+	dir2, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+	p := NewRetryPolicy(1)
+	p.BaseDelay = time.Hour
+	s = NewSpider(DiskPersistent(dir2, false, false), UseRetryPolicy(p))
+	s.AutoStop = false
+	s.RegisterHandler("page", func(ctx *Context) {})
+	s.OnError(func(ctx *Context, err error) {
+		go s.Stop()
+	})
+	s.AddTaskByName(GetReq("http://127.0.0.1:0/"), "page")
+	s.Run()
+	d, err := NewDiskScheduler(dir2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.tasks.Len() != 0 || d.delayed.Len() != 1 {
+		t.Error("wrong tasks after retrying", d.tasks.Len(), d.delayed.Len())
+	}
+
+	// the task cancelled by shutdown is kept
+	block := make(chan struct{})
+	defer close(block)
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer blocking.Close()
+	dir3, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir3)
+	s = NewSpider(DiskPersistent(dir3, false, false))
+	s.AutoStop = false
+	s.ShutdownTimeout = 200 * time.Millisecond
+	s.RegisterHandler("page", func(ctx *Context) {})
+	s.AddTaskByName(GetReq(blocking.URL), "page")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.Stop()
+	}()
+	s.Run()
+	d3, err := NewDiskScheduler(dir3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d3.Close()
+	if d3.tasks.Len() != 1 {
+		t.Error("cancelled task is lost", d3.tasks.Len())
+	}
+}
@@ -0,0 +1,164 @@
+package goribot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PrometheusNamespace is the prefix of metric names exported by PrometheusHandler
+var PrometheusNamespace = "goribot"
+
+// promWriter writes metrics in Prometheus text exposition format
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (w *promWriter) family(name, typ, help string) string {
+	name = PrometheusNamespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return name
+}
+
+func (w *promWriter) sample(name string, v float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i] + `="` + promEscaper.Replace(labels[i+1]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// histogram writes LatencyHistogram as a histogram in seconds
+func (w *promWriter) histogram(name string, h LatencyHistogram, labels ...string) {
+	var count int64
+	for i, b := range h.Buckets {
+		count += h.Counts[i]
+		w.sample(name+"_bucket", float64(count), append(labels, "le", strconv.FormatFloat(b.Seconds(), 'g', -1, 64))...)
+	}
+	w.sample(name+"_bucket", float64(h.Count), append(labels, "le", "+Inf")...)
+	w.sample(name+"_sum", h.Sum.Seconds(), labels...)
+	w.sample(name+"_count", float64(h.Count), labels...)
+}
+
+// writePrometheus writes the stats and pool utilization of spider to w
+func writePrometheus(w *promWriter, s *Spider) {
+	st := s.Stats()
+	n := w.family("requests_total", "counter", "Requests sent by Downloader.")
+	w.sample(n, float64(st.Requests))
+
+	n = w.family("responses_total", "counter", "Responses got without error by status code.")
+	codes := make([]int, 0, len(st.StatusCodes))
+	for c := range st.StatusCodes {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		w.sample(n, float64(st.StatusCodes[c]), "code", strconv.Itoa(c))
+	}
+
+	n = w.family("response_bytes_total", "counter", "Size of response bodies.")
+	w.sample(n, float64(st.Bytes))
+
+	n = w.family("errors_total", "counter", "Errors passed to OnError handlers by kind.")
+	kinds := make([]string, 0, len(st.Errors))
+	for k := range st.Errors {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		w.sample(n, float64(st.Errors[k]), "kind", k)
+	}
+
+	n = w.family("retries_total", "counter", "Requests retried by Retry extension.")
+	w.sample(n, float64(st.Retries))
+	n = w.family("tasks_dropped_total", "counter", "Tasks dropped by deduplicate extensions or Limiter.")
+	w.sample(n, float64(st.Deduplicated), "reason", "deduplicate")
+	w.sample(n, float64(st.Limited), "reason", "limiter")
+	n = w.family("tasks_added_total", "counter", "Tasks added to Scheduler.")
+	w.sample(n, float64(st.TasksAdded))
+	n = w.family("tasks_taken_total", "counter", "Tasks taken from Scheduler.")
+	w.sample(n, float64(st.TasksTaken))
+	n = w.family("items_total", "counter", "Items handled by OnItem handlers.")
+	w.sample(n, float64(st.Items))
+
+	n = w.family("queued_tasks", "gauge", "Tasks waiting in Scheduler.")
+	w.sample(n, float64(st.QueueDepth))
+	n = w.family("queued_items", "gauge", "Items waiting in Scheduler.")
+	if st.ItemsAdded > st.Items {
+		w.sample(n, float64(st.ItemsAdded-st.Items))
+	} else {
+		w.sample(n, 0)
+	}
+	n = w.family("pool_capacity", "gauge", "Capacity of task and item pool.")
+	w.sample(n, float64(s.taskPool.Cap()), "pool", "task")
+	w.sample(n, float64(s.itemPool.Cap()), "pool", "item")
+	n = w.family("pool_running", "gauge", "Running tasks and items in pool.")
+	w.sample(n, float64(st.RunningTasks), "pool", "task")
+	w.sample(n, float64(st.RunningItems), "pool", "item")
+
+	n = w.family("download_duration_seconds", "histogram", "Download latency by host.")
+	hosts := make([]string, 0, len(st.HostLatency))
+	for h := range st.HostLatency {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		w.histogram(n, st.HostLatency[h], "host", h)
+	}
+	n = w.family("handler_duration_seconds", "histogram", "Time spent in the handlers of tasks.")
+	w.histogram(n, st.HandlerLatency)
+}
+
+// PrometheusHandler returns a http.Handler serves the metrics of spider in Prometheus text format
+func PrometheusHandler(s *Spider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &promWriter{}
+		writePrometheus(pw, s)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = pw.WriteTo(w)
+	})
+}
+
+// PrometheusExporter is an extension serves the metrics of spider for Prometheus on addr with path,
+// from the spider starts to it finishes.
+func PrometheusExporter(addr, path string) func(s *Spider) {
+	return func(s *Spider) {
+		mux := http.NewServeMux()
+		mux.Handle(path, PrometheusHandler(s))
+		srv := &http.Server{Addr: addr, Handler: mux}
+		var running int32
+		s.OnStart(func(s *Spider) {
+			atomic.StoreInt32(&running, 1)
+			go func() {
+				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					Log.Error("prometheus exporter error", err)
+				}
+			}()
+		})
+		s.OnFinish(func(s *Spider) {
+			if atomic.LoadInt32(&running) == 0 {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				Log.Error("prometheus exporter shutdown error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package goribot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	s := NewSpider(PrometheusExporter(addr, "/metrics"))
+	s.AutoStop = false
+	handled := make(chan struct{})
+	s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+		ctx.AddItem(ctx.Resp.Text)
+		close(handled)
+	})
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	<-handled
+
+	var body string
+	for i := 0; i < 50; i++ { // wait for the exporter and the item
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			b, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			body = string(b)
+			if strings.Contains(body, "goribot_items_total 1\n") {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Stop()
+	<-done
+
+	host := ts.Listener.Addr().String()
+	for _, line := range []string{
+		"# TYPE goribot_requests_total counter",
+		"goribot_requests_total 1",
+		`goribot_responses_total{code="200"} 1`,
+		"goribot_response_bytes_total 13",
+		`goribot_tasks_dropped_total{reason="deduplicate"} 0`,
+		"goribot_items_total 1",
+		"goribot_queued_tasks 0",
+		fmt.Sprintf(`goribot_pool_capacity{pool="task"} %d`, s.taskPool.Cap()),
+		`goribot_pool_running{pool="item"} 0`,
+		"# TYPE goribot_download_duration_seconds histogram",
+		`goribot_download_duration_seconds_bucket{host="` + host + `",le="+Inf"} 1`,
+		`goribot_download_duration_seconds_count{host="` + host + `"} 1`,
+		`goribot_handler_duration_seconds_bucket{le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("missing metric", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Error("exporter is still running after spider finished")
+	}
+}
+
+var (
+	promCommentRe = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	promSampleRe  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\["\\n])*",?)*\})? (\S+)$`)
+)
+
+// checkPromText checks the text exposition format, and that the histograms are cumulative
+func checkPromText(t *testing.T, body string) {
+	types := map[string]string{}
+	var bucket float64
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if m := promCommentRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				if _, ok := types[m[2]]; ok {
+					t.Error("duplicate TYPE", line)
+				}
+				types[m[2]] = m[3]
+				bucket = 0
+			}
+			continue
+		}
+		m := promSampleRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Error("bad line", line)
+			continue
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Error("bad value", line)
+		}
+		name := m[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name && types[base] == "histogram" {
+				name = base
+			}
+		}
+		if _, ok := types[name]; !ok {
+			t.Error("sample without TYPE", line)
+		}
+		if strings.HasSuffix(m[1], "_bucket") {
+			if v < bucket {
+				t.Error("histogram isn't cumulative", line)
+			}
+			bucket = v
+			if strings.Contains(m[2], `le="+Inf"`) {
+				bucket = 0
+			}
+		}
+	}
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	s := NewSpider()
+	s.stats.response("example.com", 200, 10, 120*time.Millisecond)
+	s.stats.response("example.com", 404, 10, 3*time.Second)
+	s.stats.error(DownloaderErr{context.DeadlineExceeded, Get("http://example.com"), nil})
+	rec := httptest.NewRecorder()
+	PrometheusHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	checkPromText(t, rec.Body.String())
+
+	w := &promWriter{}
+	w.sample("goribot_test", 1, "host", "a\"b\\c\nd")
+	if w.String() != `goribot_test{host="a\"b\\c\nd"} 1`+"\n" {
+		t.Error("wrong escaping", w.String())
+	}
+	w.Reset()
+	n := w.family("test_duration_seconds", "histogram", "Test.")
+	w.histogram(n, LatencyHistogram{Buckets: LatencyBuckets[:2], Counts: []int64{1, 2, 3}, Count: 6, Sum: time.Second}, "host", "h")
+	checkPromText(t, w.String())
+	if !strings.Contains(w.String(), `goribot_test_duration_seconds_bucket{host="h",le="0.1"} 3`+"\n") ||
+		!strings.Contains(w.String(), `goribot_test_duration_seconds_count{host="h"} 6`+"\n") {
+		t.Error("wrong histogram", w.String())
+	}
+}
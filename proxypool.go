@@ -0,0 +1,391 @@
+package goribot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoProxy = errors.New("no available proxy in pool")
+var ErrProxyBanned = errors.New("proxy is banned by site")
+
+// ProxyStat is the statistics of a proxy in ProxyPool
+type ProxyStat struct {
+	URL                 string
+	Requests            int64
+	Successes           int64
+	Failures            int64
+	Bans                int64
+	ConsecutiveFailures int
+	// Latency is the mean latency of successful requests
+	Latency time.Duration
+	// QuarantinedUntil is when the quarantined proxy will be checked again, it's zero if the proxy is available
+	QuarantinedUntil time.Time
+}
+
+// SuccessRate returns the rate of successful requests, it's 1 for a proxy never used
+func (s ProxyStat) SuccessRate() float64 {
+	if s.Requests == 0 {
+		return 1
+	}
+	return float64(s.Successes) / float64(s.Requests)
+}
+
+// Quarantined reports whether the proxy isn't used for now
+func (s ProxyStat) Quarantined() bool {
+	return !s.QuarantinedUntil.IsZero()
+}
+
+type proxyState struct {
+	ProxyStat
+	latencySum time.Duration
+}
+
+// ProxyPool is a set of proxies tracks their health.
+// Proxies are picked randomly weighted by success rate, and quarantined after MaxFailures consecutive failures
+// or a ban. Quarantined proxies are checked with CheckURL after QuarantineTime and come back if it succeeds.
+type ProxyPool struct {
+	// MaxFailures is the consecutive failures to quarantine a proxy
+	MaxFailures int
+	// QuarantineTime is how long a quarantined proxy waits before checking
+	QuarantineTime time.Duration
+	// BanCodes are the status codes of responses meaning the proxy is banned by site
+	BanCodes []int
+	// BanPatterns are the patterns of response body meaning the proxy is banned, like the captcha page of the site.
+	// It's empty by default because a pattern like "captcha" also matches the normal pages with a captcha widget.
+	BanPatterns []*regexp.Regexp
+	// CheckURL is requested through quarantined proxies to check them, empty means releasing them after QuarantineTime
+	CheckURL string
+	// CheckInterval is the interval of checking quarantined proxies and reloading proxies from Provider
+	CheckInterval time.Duration
+	// Provider loads proxies for reloading, nil means never reload
+	Provider func() ([]string, error)
+	// ReloadInterval is the interval of reloading proxies from Provider, zero means only loading at start
+	ReloadInterval time.Duration
+
+	lock       sync.Mutex
+	proxies    map[string]*proxyState
+	rand       *rand.Rand
+	checker    *BaseDownloader
+	lastReload time.Time
+}
+
+// NewProxyPool creates a ProxyPool with proxies and default settings
+func NewProxyPool(proxies ...string) *ProxyPool {
+	checker := NewBaseDownloader()
+	checker.TransportConfig.Timeout = 10 * time.Second
+	p := &ProxyPool{
+		MaxFailures:    3,
+		QuarantineTime: 5 * time.Minute,
+		BanCodes:       []int{403, 429},
+		CheckInterval:  30 * time.Second,
+		proxies:        map[string]*proxyState{},
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		checker:        checker,
+	}
+	p.Add(proxies...)
+	return p
+}
+
+// Add adds proxies to pool, the existing ones are ignored
+func (p *ProxyPool) Add(proxies ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, u := range proxies {
+		if _, ok := p.proxies[u]; !ok && u != "" {
+			p.proxies[u] = &proxyState{ProxyStat: ProxyStat{URL: u}}
+		}
+	}
+}
+
+// Remove removes proxies from pool
+func (p *ProxyPool) Remove(proxies ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, u := range proxies {
+		delete(p.proxies, u)
+	}
+}
+
+// Reload replaces the proxies of pool, the stats of proxies still in pool are kept
+func (p *ProxyPool) Reload(proxies []string) {
+	keep := map[string]struct{}{}
+	for _, u := range proxies {
+		keep[u] = struct{}{}
+	}
+	p.lock.Lock()
+	for u := range p.proxies {
+		if _, ok := keep[u]; !ok {
+			delete(p.proxies, u)
+		}
+	}
+	p.lock.Unlock()
+	p.Add(proxies...)
+}
+
+// LoadFile reloads proxies from a file with a proxy url per line, the empty lines and lines start with "#" are ignored
+func (p *ProxyPool) LoadFile(path string) error {
+	proxies, err := FileProxyProvider(path)()
+	if err != nil {
+		return err
+	}
+	p.Reload(proxies)
+	return nil
+}
+
+// FileProxyProvider returns a provider loads proxies from a file like ProxyPool.LoadFile
+func FileProxyProvider(path string) func() ([]string, error) {
+	return func() ([]string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var res []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				res = append(res, line)
+			}
+		}
+		return res, scanner.Err()
+	}
+}
+
+// Get picks an available proxy randomly weighted by success rate
+func (p *ProxyPool) Get() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	var candidates []*proxyState
+	total := 0.0
+	for _, s := range p.proxies {
+		if s.Quarantined() {
+			if p.CheckURL != "" || now.Before(s.QuarantinedUntil) {
+				continue
+			}
+			s.QuarantinedUntil = time.Time{}
+			s.ConsecutiveFailures = 0
+		}
+		candidates = append(candidates, s)
+		total += proxyWeight(s)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	// sort to make picking stable for the same random number
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].URL < candidates[j].URL })
+	r := p.rand.Float64() * total
+	for _, s := range candidates {
+		r -= proxyWeight(s)
+		if r < 0 {
+			return s.URL, true
+		}
+	}
+	return candidates[len(candidates)-1].URL, true
+}
+
+// proxyWeight is the smoothed success rate of proxy
+func proxyWeight(s *proxyState) float64 {
+	return float64(s.Successes+1) / float64(s.Requests+2)
+}
+
+// Success records a successful request through proxy
+func (p *ProxyPool) Success(proxy string, latency time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.proxies[proxy]; ok {
+		s.Requests += 1
+		s.Successes += 1
+		s.ConsecutiveFailures = 0
+		s.latencySum += latency
+		s.Latency = s.latencySum / time.Duration(s.Successes)
+	}
+}
+
+// Failure records a failed request through proxy, the proxy is quarantined after MaxFailures consecutive failures
+func (p *ProxyPool) Failure(proxy string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.proxies[proxy]; ok {
+		s.Requests += 1
+		s.Failures += 1
+		s.ConsecutiveFailures += 1
+		if p.MaxFailures > 0 && s.ConsecutiveFailures >= p.MaxFailures && !s.Quarantined() {
+			Log.Warning("Proxy", proxy, "failed", s.ConsecutiveFailures, "times, quarantine it")
+			s.QuarantinedUntil = time.Now().Add(p.QuarantineTime)
+		}
+	}
+}
+
+// Ban records a banned request through proxy and quarantines it
+func (p *ProxyPool) Ban(proxy string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.proxies[proxy]; ok {
+		s.Requests += 1
+		s.Failures += 1
+		s.Bans += 1
+		if !s.Quarantined() {
+			Log.Warning("Proxy", proxy, "is banned, quarantine it")
+		}
+		s.QuarantinedUntil = time.Now().Add(p.QuarantineTime)
+	}
+}
+
+// Stats returns the stats of all proxies sorted by url
+func (p *ProxyPool) Stats() []ProxyStat {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	res := make([]ProxyStat, 0, len(p.proxies))
+	for _, s := range p.proxies {
+		res = append(res, s.ProxyStat)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].URL < res[j].URL })
+	return res
+}
+
+// banned reports whether the response means the proxy is banned
+func (p *ProxyPool) banned(resp *Response) bool {
+	for _, c := range p.BanCodes {
+		if resp.StatusCode == c {
+			return true
+		}
+	}
+	if resp.BodyReader == nil {
+		for _, r := range p.BanPatterns {
+			if r.Match(resp.Body) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check checks the quarantined proxies whose QuarantineTime passed with CheckURL and releases the working ones,
+// and reloads proxies from Provider if it's time.
+func (p *ProxyPool) Check() {
+	p.lock.Lock()
+	reload := p.Provider != nil && p.ReloadInterval > 0 && time.Since(p.lastReload) >= p.ReloadInterval
+	p.lock.Unlock()
+	if reload {
+		p.reload()
+	}
+	if p.CheckURL == "" {
+		return
+	}
+	now := time.Now()
+	var due []string
+	p.lock.Lock()
+	for _, s := range p.proxies {
+		if s.Quarantined() && !now.Before(s.QuarantinedUntil) {
+			due = append(due, s.URL)
+		}
+	}
+	p.lock.Unlock()
+	for _, u := range due {
+		resp, err := p.checker.Do(Get(p.CheckURL).SetProxy(u))
+		ok := err == nil && resp.StatusCode < 400 && !p.banned(resp)
+		p.lock.Lock()
+		if s, exist := p.proxies[u]; exist {
+			if ok {
+				Log.Info("Proxy", u, "works again")
+				s.QuarantinedUntil = time.Time{}
+				s.ConsecutiveFailures = 0
+			} else {
+				s.QuarantinedUntil = time.Now().Add(p.QuarantineTime)
+			}
+		}
+		p.lock.Unlock()
+	}
+	p.checker.CloseIdleConnections()
+}
+
+func (p *ProxyPool) reload() {
+	p.lock.Lock()
+	p.lastReload = time.Now()
+	p.lock.Unlock()
+	proxies, err := p.Provider()
+	if err != nil {
+		Log.Error("load proxies error", err)
+		return
+	}
+	p.Reload(proxies)
+}
+
+// UseProxyPool is an extension sends requests without proxy through the proxies in pool,
+// and records the result of every request to pool. The banned responses fail with ErrProxyBanned,
+// and requests fail with ErrNoProxy if all proxies are quarantined.
+func UseProxyPool(p *ProxyPool) func(s *Spider) {
+	return func(s *Spider) {
+		done := make(chan struct{})
+		s.OnStart(func(s *Spider) {
+			if p.Provider != nil {
+				p.reload()
+			}
+			go func() {
+				interval := p.CheckInterval
+				if interval <= 0 {
+					interval = 30 * time.Second
+				}
+				t := time.NewTicker(interval)
+				defer t.Stop()
+				for {
+					select {
+					case <-t.C:
+						p.Check()
+					case <-done:
+						return
+					}
+				}
+			}()
+		})
+		s.OnFinish(func(s *Spider) {
+			close(done)
+		})
+		s.Downloader.AddMiddleware(func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+			if req.Err != nil {
+				return next(req)
+			}
+			_, ok := req.Meta["ProxyPool"]
+			if req.ProxyURL != "" && !ok {
+				return next(req)
+			}
+			proxy, ok := p.Get()
+			if !ok {
+				return nil, DownloaderErr{ErrNoProxy, req, nil}
+			}
+			req.ProxyURL = proxy
+			req.Meta["ProxyPool"] = proxy
+			start := time.Now()
+			resp, err = next(req)
+			if err != nil {
+				// the errors with response like ErrBodyTooLarge aren't caused by proxy
+				// and the cancelled ones by Spider.Stop or the user neither
+				var de DownloaderErr
+				if errors.As(err, &de) && de.Response != nil {
+					p.Success(proxy, time.Since(start))
+				} else if !errors.Is(err, context.Canceled) {
+					p.Failure(proxy)
+				}
+				return resp, err
+			}
+			if p.banned(resp) {
+				p.Ban(proxy)
+				_ = resp.CloseBody()
+				return nil, DownloaderErr{fmt.Errorf("%w: %s", ErrProxyBanned, proxy), req, resp}
+			}
+			p.Success(proxy, time.Since(start))
+			return resp, nil
+		})
+	}
+}
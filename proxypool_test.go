@@ -0,0 +1,125 @@
+package goribot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyPool(t *testing.T) {
+	var banned int64 = 1
+	newProxy := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if name == "banned" && atomic.LoadInt64(&banned) == 1 {
+				_, _ = fmt.Fprintf(w, "<html><body>Please solve the CAPTCHA</body></html>")
+				return
+			}
+			_, _ = fmt.Fprintf(w, "<html><body>"+name+"</body></html>")
+		}))
+	}
+	good, ban := newProxy("good"), newProxy("banned")
+	defer good.Close()
+	defer ban.Close()
+	dead := newProxy("dead")
+	dead.Close()
+
+	p := NewProxyPool(good.URL, ban.URL, dead.URL)
+	p.MaxFailures = 2
+	p.QuarantineTime = 0
+	p.CheckURL = "http://example.com/"
+	p.BanPatterns = []*regexp.Regexp{regexp.MustCompile(`(?i)captcha`)}
+	var errs, ok, noProxy int64
+	s := NewSpider(UseProxyPool(p))
+	s.OnError(func(ctx *Context, err error) {
+		if errors.Is(err, ErrNoProxy) {
+			atomic.AddInt64(&noProxy, 1)
+		}
+		atomic.AddInt64(&errs, 1)
+	})
+	for i := 0; i < 20; i++ {
+		s.AddTask(Get(fmt.Sprint("http://example.com/", i)), func(ctx *Context) {
+			if ctx.Resp.Dom.Find("body").Text() != "good" {
+				t.Error("wrong response", ctx.Resp.Text)
+			}
+			atomic.AddInt64(&ok, 1)
+		})
+	}
+	s.SetTaskPoolSize(1)
+	s.Run()
+	if atomic.LoadInt64(&ok)+atomic.LoadInt64(&errs) != 20 || atomic.LoadInt64(&noProxy) != 0 {
+		t.Error("wrong results", ok, errs, noProxy)
+	}
+	stats := map[string]ProxyStat{}
+	for _, st := range p.Stats() {
+		stats[st.URL] = st
+	}
+	if st := stats[ban.URL]; st.Bans != 1 || !st.Quarantined() {
+		t.Error("banned proxy isn't quarantined", st)
+	}
+	if st := stats[dead.URL]; st.Failures != 2 || !st.Quarantined() {
+		t.Error("dead proxy isn't quarantined", st)
+	}
+	if st := stats[good.URL]; st.Failures != 0 || st.Successes != atomic.LoadInt64(&ok) || st.Quarantined() || st.SuccessRate() != 1 {
+		t.Error("wrong stats of good proxy", st)
+	}
+
+	atomic.StoreInt64(&banned, 0)
+	p.Check()
+	for _, st := range p.Stats() {
+		if st.URL != dead.URL && st.Quarantined() {
+			t.Error("proxy isn't released", st)
+		}
+		if st.URL == dead.URL && !st.Quarantined() {
+			t.Error("dead proxy is released")
+		}
+	}
+
+	f, err := ioutil.TempFile("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = fmt.Fprintf(f, "# proxies\n%s\n\nsocks5://127.0.0.1:1080\n", good.URL)
+	f.Close()
+	p.Provider = FileProxyProvider(f.Name())
+	p.ReloadInterval = time.Millisecond
+	p.Check()
+	if st := p.Stats(); len(st) != 2 || st[0].URL != good.URL || st[0].Successes == 0 {
+		t.Error("wrong reloaded proxies", st)
+	}
+
+	p = NewProxyPool(dead.URL)
+	p.MaxFailures = 1
+	d := NewBaseDownloader()
+	UseProxyPool(p)(&Spider{Downloader: d})
+	if _, err := d.Do(Get("http://example.com/")); err == nil {
+		t.Error("dead proxy should fail")
+	}
+	if _, err := d.Do(Get("http://example.com/")); !errors.Is(err, ErrNoProxy) {
+		t.Error("ErrNoProxy isn't returned", err)
+	}
+
+	p = NewProxyPool(good.URL)
+	p.MaxFailures = 1
+	d = NewBaseDownloader()
+	UseProxyPool(p)(&Spider{Downloader: d})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := Get("http://example.com/")
+	req.Request = req.Request.WithContext(ctx)
+	if _, err := d.Do(req); !errors.Is(err, context.Canceled) {
+		t.Error("request isn't cancelled", err)
+	}
+	if st := p.Stats(); st[0].Failures != 0 || st[0].Quarantined() {
+		t.Error("cancelled request is counted as proxy failure", st)
+	}
+}
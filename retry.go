@@ -0,0 +1,202 @@
+package goribot
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides which requests are retried and how long to wait before retrying
+type RetryPolicy struct {
+	// MaxTimes is the max retry times of a request
+	MaxTimes int
+	// OkCodes are the status codes of successful responses, responses with other codes are retried.
+	// Empty means only retrying the RetryCodes.
+	OkCodes []int
+	// RetryCodes are the status codes of responses to retry if OkCodes is empty
+	RetryCodes []int
+	// ErrorKinds are the kinds of DownloaderErr to retry like ErrKindTimeout,
+	// empty means retrying the transient errors of ErrKindTimeout and ErrKindDownload.
+	// The canceled requests and the errors in permanentErrors are never retried.
+	ErrorKinds []string
+	// BaseDelay is the delay before the first retry, it doubles every retry
+	BaseDelay time.Duration
+	// MaxDelay is the max delay of backoff, zero means no limit
+	MaxDelay time.Duration
+	// Jitter is the ratio of delay randomly added or removed, like 0.2 for ±20%
+	Jitter float64
+	// OnGiveUp is called when a request still fails after MaxTimes retries.
+	// err is nil if the request failed with a status code, and the response is ctx.Resp.
+	OnGiveUp func(ctx *Context, err error)
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// NewRetryPolicy creates a RetryPolicy retries errors and the status codes usually meaning temporary failure
+// with exponential backoff from 500ms to 1m.
+func NewRetryPolicy(maxTimes int) *RetryPolicy {
+	return &RetryPolicy{
+		MaxTimes:   maxTimes,
+		RetryCodes: []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   time.Minute,
+		Jitter:     0.2,
+	}
+}
+
+// RetryTimes returns how many times the request has been retried
+func RetryTimes(req *Request) int {
+	if t, ok := req.Meta["RetryTimes"].(int); ok {
+		return t
+	}
+	return 0
+}
+
+// permanentErrors are the errors failing again if the request is retried
+var permanentErrors = []error{
+	ErrBodyTooLarge,
+	ErrContentTypeNotAllowed,
+	ErrNoFixture,
+	ErrNotArchived,
+	ErrProxyScheme,
+}
+
+// ShouldRetryErr reports whether the request failed with err should be retried
+func (p *RetryPolicy) ShouldRetryErr(err error) bool {
+	var e DownloaderErr
+	if !errors.As(err, &e) || e.Request == nil {
+		return false
+	}
+	if e.Request.Request != nil && e.Request.Context().Err() != nil {
+		return false // canceled by Spider.Stop or the user
+	}
+	for _, pe := range permanentErrors {
+		if errors.Is(err, pe) {
+			return false
+		}
+	}
+	kind := e.Kind()
+	if kind == ErrKindCanceled {
+		return false
+	}
+	if len(p.ErrorKinds) == 0 {
+		return kind == ErrKindTimeout || kind == ErrKindDownload
+	}
+	for _, k := range p.ErrorKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldRetryCode reports whether the response with status code should be retried
+func (p *RetryPolicy) ShouldRetryCode(code int) bool {
+	if len(p.OkCodes) > 0 {
+		for _, c := range p.OkCodes {
+			if c == code {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range p.RetryCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the delay before the retry of times, resp could be nil.
+// The Retry-After header of 429 and 503 responses is honoured if it's longer than backoff.
+func (p *RetryPolicy) Delay(times int, resp *Response) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < times && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		p.randLock.Lock()
+		if p.rand == nil {
+			p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		d += time.Duration((p.rand.Float64()*2 - 1) * p.Jitter * float64(d))
+		p.randLock.Unlock()
+	}
+	if resp != nil && resp.Response != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if ra, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && ra > d {
+			d = ra
+		}
+	}
+	return d
+}
+
+// retryAfter parses the Retry-After header in seconds or http date
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// UseRetryPolicy is an extension retries the failed requests by policy.
+// The retried requests are added to Scheduler again with Request.NotBefore after the delay, so workers aren't blocked,
+// and they are not dropped by ReqDeduplicate.
+func UseRetryPolicy(p *RetryPolicy) func(s *Spider) {
+	return func(s *Spider) {
+		retry := func(ctx *Context, req *Request, resp *Response, err error) bool {
+			ctx.unfinished = false // retried or given up
+			times := RetryTimes(req)
+			if times >= p.MaxTimes {
+				if p.OnGiveUp != nil {
+					p.OnGiveUp(ctx, err)
+				}
+				return false
+			}
+			times += 1
+			delay := p.Delay(times, resp)
+			Log.Info("Request to", req.URL, "[tried", times, "times]", "got error.Retry after", delay)
+			s.stats.retry()
+			// the sent request's body is read and its context belongs to the last attempt
+			r := req.Clone()
+			r.Meta["RetryTimes"] = times
+			r.NotBefore = time.Now().Add(delay)
+			s.addTask(ctx.copyTask(r))
+			return true
+		}
+		s.OnError(func(ctx *Context, err error) {
+			if !p.ShouldRetryErr(err) {
+				return
+			}
+			var e DownloaderErr
+			errors.As(err, &e)
+			retry(ctx, e.Request, e.Response, err)
+		})
+		s.OnResp(func(ctx *Context) {
+			if p.ShouldRetryCode(ctx.Resp.StatusCode) && retry(ctx, ctx.Req, ctx.Resp, nil) {
+				ctx.Abort()
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package goribot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var ti int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/busy":
+			if atomic.AddInt64(&ti, 1) < 2 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+
+	var got, gaveUp int64
+	p := NewRetryPolicy(2)
+	p.BaseDelay = 10 * time.Millisecond
+	p.OnGiveUp = func(ctx *Context, err error) {
+		if err != nil || ctx.Resp.StatusCode != http.StatusBadGateway || RetryTimes(ctx.Req) != 2 {
+			t.Error("wrong give up", err)
+		}
+		atomic.AddInt64(&gaveUp, 1)
+	}
+	s := NewSpider(UseRetryPolicy(p))
+	start := time.Now()
+	s.AddTask(Get(ts.URL+"/busy"), func(ctx *Context) {
+		if ctx.Resp.StatusCode == http.StatusOK {
+			atomic.AddInt64(&got, 1)
+		}
+	})
+	s.AddTask(Get(ts.URL+"/created"), func(ctx *Context) {
+		atomic.AddInt64(&got, 1)
+	})
+	s.AddTask(Get(ts.URL+"/down"), func(ctx *Context) {})
+	s.Run()
+	if time.Since(start) < time.Second {
+		t.Error("Retry-After isn't honoured", time.Since(start))
+	}
+	if atomic.LoadInt64(&got) != 2 || atomic.LoadInt64(&gaveUp) != 1 || atomic.LoadInt64(&ti) != 2 {
+		t.Error("wrong results", got, gaveUp, ti)
+	}
+	if s.Stats().Retries != 3 {
+		t.Error("wrong retries", s.Stats().Retries)
+	}
+}
+
+func TestRetryOkCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	var got int64
+	s := NewSpider(Retry(3, http.StatusOK, http.StatusCreated))
+	s.AddTask(Get(ts.URL), func(ctx *Context) {
+		atomic.AddInt64(&got, 1)
+	})
+	s.Run()
+	if atomic.LoadInt64(&got) != 1 || s.Stats().Retries != 0 {
+		t.Error("response with a later ok code is retried", got, s.Stats().Retries)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := NewRetryPolicy(5)
+	p.BaseDelay, p.MaxDelay, p.Jitter = time.Second, 3*time.Second, 0
+	for times, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 10: 3 * time.Second} {
+		if d := p.Delay(times, nil); d != want {
+			t.Error("wrong delay", times, d)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1, nil); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Error("wrong jitter", d)
+		}
+	}
+	now := time.Now()
+	if d, ok := retryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now); !ok || d < 59*time.Second || d > time.Minute {
+		t.Error("wrong Retry-After date", d)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("invalid Retry-After is accepted")
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestRetryErrors(t *testing.T) {
+	p := NewRetryPolicy(3)
+	canceled := Get("http://example.com")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled.Request = canceled.WithContext(ctx)
+	cases := []struct {
+		err   error
+		retry bool
+	}{
+		{DownloaderErr{timeoutErr{}, Get("http://example.com"), nil}, true},
+		{DownloaderErr{context.DeadlineExceeded, Get("http://example.com"), nil}, true},
+		{DownloaderErr{errors.New("connection reset by peer"), Get("http://example.com"), nil}, true},
+		{DownloaderErr{fmt.Errorf("%w: http://proxy", ErrProxyBanned), Get("http://example.com"), nil}, true},
+		{DownloaderErr{ErrBodyTooLarge, Get("http://example.com"), nil}, false},
+		{DownloaderErr{ErrContentTypeNotAllowed, Get("http://example.com"), nil}, false},
+		{DownloaderErr{fmt.Errorf("%w: GET http://example.com", ErrNoFixture), Get("http://example.com"), nil}, false},
+		{DownloaderErr{ErrNotArchived, Get("http://example.com"), nil}, false},
+		{DownloaderErr{context.Canceled, Get("http://example.com"), nil}, false},
+		{DownloaderErr{errors.New("connection reset by peer"), canceled, nil}, false},
+		{errors.New("not a downloader error"), false},
+	}
+	for i, c := range cases {
+		if res := p.ShouldRetryErr(c.err); res != c.retry {
+			t.Errorf("case %d: ShouldRetryErr(%v) = %v", i, c.err, res)
+		}
+	}
+
+	p.ErrorKinds = []string{ErrKindTimeout, ErrKindCanceled}
+	if p.ShouldRetryErr(DownloaderErr{errors.New("connection reset by peer"), Get("http://example.com"), nil}) {
+		t.Error("error kind isn't checked")
+	}
+	if !p.ShouldRetryErr(DownloaderErr{timeoutErr{}, Get("http://example.com"), nil}) {
+		t.Error("timeout isn't retried")
+	}
+	if p.ShouldRetryErr(DownloaderErr{context.Canceled, Get("http://example.com"), nil}) {
+		t.Error("canceled request is retried")
+	}
+}
+
+func TestRetryNoFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var errs int64
+	s := NewSpider(ReplayFixtures(dir), Retry(3))
+	s.OnError(func(ctx *Context, err error) {
+		atomic.AddInt64(&errs, 1)
+	})
+	s.AddTask(Get("http://example.com/missing"), func(ctx *Context) {})
+	s.Run()
+	if atomic.LoadInt64(&errs) != 1 || s.Stats().Retries != 0 {
+		t.Error("missing fixture is retried", errs, s.Stats().Retries)
+	}
+}
+
+func TestRetryPost(t *testing.T) {
+	var ti int64
+	bodies := make(chan string, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Header.Get("Goribot") + " " + string(b)
+		if atomic.AddInt64(&ti, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	p := NewRetryPolicy(3)
+	p.BaseDelay = 10 * time.Millisecond
+	s := NewSpider(UseRetryPolicy(p))
+	req := PostRawReq(ts.URL, []byte("hello")).SetHeader("Goribot", "hi")
+	var got int64
+	s.AddTask(req, func(ctx *Context) {
+		if ctx.Resp.StatusCode == http.StatusOK && RetryTimes(ctx.Req) == 2 {
+			atomic.AddInt64(&got, 1)
+		}
+	})
+	s.Run()
+	close(bodies)
+	for b := range bodies {
+		if b != "hi hello" {
+			t.Error("wrong retried request", b)
+		}
+	}
+	if atomic.LoadInt64(&ti) != 3 || atomic.LoadInt64(&got) != 1 {
+		t.Error("wrong retries", ti, got)
+	}
+	if RetryTimes(req) != 0 {
+		t.Error("the sent request is modified", RetryTimes(req))
+	}
+}
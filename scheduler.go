@@ -1,10 +1,16 @@
 package goribot
 
 import (
+	"container/heap"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 )
 
-// Scheduler is a queue of tasks and items
+// Scheduler is a queue of tasks and items.
+// A task whose Request.NotBefore is in the future should not be popped until that time,
+// and it still makes the tasks queue not empty.
 type Scheduler interface {
 	// GetTask pops a task
 	GetTask() *Task
@@ -22,59 +28,498 @@ type Scheduler interface {
 	IsItemEmpty() bool
 }
 
+// NotifyScheduler is a Scheduler which notifies spider when tasks or items are available,
+// so spider could wait for them instead of polling the scheduler.
+type NotifyScheduler interface {
+	Scheduler
+	// TaskNotify returns a channel receives a value when tasks may be available
+	TaskNotify() <-chan struct{}
+	// ItemNotify returns a channel receives a value when items may be available
+	ItemNotify() <-chan struct{}
+}
+
+// schedulerNotify returns the notify channels of scheduler, or nil channels if it isn't a NotifyScheduler
+func schedulerNotify(s Scheduler) (tasks, items <-chan struct{}) {
+	if n, ok := s.(NotifyScheduler); ok {
+		return n.TaskNotify(), n.ItemNotify()
+	}
+	return nil, nil
+}
+
+// notify sends a signal to a buffered channel without blocking
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// TaskDoneScheduler is a Scheduler which wants to know when a task from GetTask has been handled.
+// Spider calls TaskDone after the new tasks and items created by the task were added.
+// It isn't called for the tasks cancelled by shutdown, or failed without being retried,
+// so they could be handled again by the next run.
+type TaskDoneScheduler interface {
+	Scheduler
+	// TaskDone marks the task as handled
+	TaskDone(t *Task)
+}
+
+// ItemDoneScheduler is a Scheduler which wants to know when an item from GetItem has been handled.
+// Spider calls ItemDone after all OnItem handlers returned.
+type ItemDoneScheduler interface {
+	Scheduler
+	// ItemDone marks the item as handled
+	ItemDone(i interface{})
+}
+
+// DelayScheduler is a Scheduler which knows when its delayed tasks will be ready,
+// so spider could sleep until then instead of polling the scheduler.
+type DelayScheduler interface {
+	Scheduler
+	// NextTaskTime returns the earliest Request.NotBefore if all the tasks in queue are delayed,
+	// ok is false if there is no task or some tasks could be popped now.
+	NextTaskTime() (at time.Time, ok bool)
+}
+
+// nextTaskWait returns how long spider could wait for the next task of scheduler, at most max
+func nextTaskWait(s Scheduler, max time.Duration) (time.Duration, bool) {
+	d, ok := s.(DelayScheduler)
+	if !ok {
+		return 0, false
+	}
+	at, ok := d.NextTaskTime()
+	if !ok {
+		return 0, false
+	}
+	wait := time.Until(at)
+	if wait < 0 {
+		wait = 0
+	} else if wait > max {
+		wait = max
+	}
+	return wait, true
+}
+
+type delayedValue struct {
+	at    time.Time
+	seq   uint64
+	value interface{}
+}
+
+// delayHeap is a min-heap ordered by time, and FIFO among the same time
+type delayHeap []delayedValue
+
+func (h delayHeap) Len() int { return len(h) }
+func (h delayHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(delayedValue)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	old[n-1] = delayedValue{}
+	*h = old[:n-1]
+	return v
+}
+
+// delayQueue keeps the values until their time, it's used by schedulers for the tasks with Request.NotBefore.
+// It's not safe for concurrent use.
+type delayQueue struct {
+	values delayHeap
+	seq    uint64
+}
+
+func (q *delayQueue) push(at time.Time, v interface{}) {
+	heap.Push(&q.values, delayedValue{at: at, seq: q.seq, value: v})
+	q.seq += 1
+}
+
+// pop pops the earliest value whose time is not after now
+func (q *delayQueue) pop(now time.Time) (interface{}, bool) {
+	if len(q.values) == 0 || q.values[0].at.After(now) {
+		return nil, false
+	}
+	return heap.Pop(&q.values).(delayedValue).value, true
+}
+
+// next returns the time of the earliest value
+func (q *delayQueue) next() (time.Time, bool) {
+	if len(q.values) == 0 {
+		return time.Time{}, false
+	}
+	return q.values[0].at, true
+}
+
+func (q *delayQueue) Len() int {
+	return len(q.values)
+}
+
+// isDelayed reports whether the task should wait for its Request.NotBefore
+func isDelayed(t *Task, now time.Time) bool {
+	return t.Request != nil && t.Request.NotBefore.After(now)
+}
+
 // Scheduler is default scheduler of goribot
 type BaseScheduler struct {
 	tasksLock sync.Mutex
 	tasks     []*Task
+	delayed   delayQueue
 	itemsLock sync.Mutex
 	items     []interface{}
 	// DepthFirst sets push new tasks to the top of the queue
 	DepthFirst bool
+	taskNotify chan struct{}
+	itemNotify chan struct{}
 }
 
 func NewBaseScheduler(depthFirst bool) *BaseScheduler {
-	return &BaseScheduler{DepthFirst: depthFirst, tasksLock: sync.Mutex{}, itemsLock: sync.Mutex{}}
+	return &BaseScheduler{
+		DepthFirst: depthFirst,
+		tasksLock:  sync.Mutex{},
+		itemsLock:  sync.Mutex{},
+		taskNotify: make(chan struct{}, 1),
+		itemNotify: make(chan struct{}, 1),
+	}
 }
 
 func (s *BaseScheduler) GetTask() *Task {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	now := time.Now()
+	for {
+		t, ok := s.delayed.pop(now)
+		if !ok {
+			break
+		}
+		s.pushTask(t.(*Task))
+	}
 	if len(s.tasks) == 0 {
 		return nil
 	}
-	s.tasksLock.Lock()
 	task := s.tasks[0]
+	s.tasks[0] = nil
 	s.tasks = s.tasks[1:]
-	s.tasksLock.Unlock()
 	return task
-
 }
 func (s *BaseScheduler) GetItem() interface{} {
+	s.itemsLock.Lock()
+	defer s.itemsLock.Unlock()
 	if len(s.items) == 0 {
 		return nil
 	}
-	s.itemsLock.Lock()
 	item := s.items[0]
+	s.items[0] = nil
 	s.items = s.items[1:]
-	s.itemsLock.Unlock()
 	return item
 }
 func (s *BaseScheduler) AddTask(t *Task) {
 	s.tasksLock.Lock()
+	if isDelayed(t, time.Now()) {
+		s.delayed.push(t.Request.NotBefore, t)
+	} else {
+		s.pushTask(t)
+	}
+	s.tasksLock.Unlock()
+	notify(s.taskNotify)
+}
+func (s *BaseScheduler) pushTask(t *Task) {
 	if s.DepthFirst {
 		s.tasks = append([]*Task{t}, s.tasks...)
 	} else {
 		s.tasks = append(s.tasks, t)
 	}
-	s.tasksLock.Unlock()
 }
 func (s *BaseScheduler) AddItem(i interface{}) {
 	s.itemsLock.Lock()
 	s.items = append(s.items, i)
 	s.itemsLock.Unlock()
-
+	notify(s.itemNotify)
 }
 func (s *BaseScheduler) IsTaskEmpty() bool {
-	return len(s.tasks) == 0
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	return len(s.tasks) == 0 && s.delayed.Len() == 0
+}
+func (s *BaseScheduler) NextTaskTime() (time.Time, bool) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	if len(s.tasks) > 0 {
+		return time.Time{}, false
+	}
+	return s.delayed.next()
 }
 func (s *BaseScheduler) IsItemEmpty() bool {
+	s.itemsLock.Lock()
+	defer s.itemsLock.Unlock()
 	return len(s.items) == 0
 }
+func (s *BaseScheduler) TaskNotify() <-chan struct{} {
+	return s.taskNotify
+}
+func (s *BaseScheduler) ItemNotify() <-chan struct{} {
+	return s.itemNotify
+}
+
+type priorityTask struct {
+	task     *Task
+	priority int
+	seq      uint64
+}
+
+// taskHeap is a max-heap of tasks ordered by priority, and FIFO among the same priority
+type taskHeap []priorityTask
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h taskHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(priorityTask)) }
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = priorityTask{}
+	*h = old[:n-1]
+	return t
+}
+
+// PriorityScheduler is a scheduler pops the task with the highest Request.Priority first.
+// Tasks with the same priority are popped in the order they were added.
+type PriorityScheduler struct {
+	tasksLock  sync.Mutex
+	tasks      taskHeap
+	delayed    delayQueue
+	seq        uint64
+	taskNotify chan struct{}
+	base       *BaseScheduler
+}
+
+func NewPriorityScheduler() *PriorityScheduler {
+	return &PriorityScheduler{taskNotify: make(chan struct{}, 1), base: NewBaseScheduler(false)}
+}
+
+// taskPriority returns Request.Priority of task, or the depth if priority is not set
+func taskPriority(t *Task) int {
+	if t.Request.Priority != 0 {
+		return t.Request.Priority
+	}
+	return t.Request.Depth
+}
+
+func (s *PriorityScheduler) GetTask() *Task {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	now := time.Now()
+	for {
+		t, ok := s.delayed.pop(now)
+		if !ok {
+			break
+		}
+		s.pushTask(t.(*Task))
+	}
+	if s.tasks.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&s.tasks).(priorityTask).task
+}
+func (s *PriorityScheduler) GetItem() interface{} {
+	return s.base.GetItem()
+}
+func (s *PriorityScheduler) AddTask(t *Task) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	if isDelayed(t, time.Now()) {
+		s.delayed.push(t.Request.NotBefore, t)
+	} else {
+		s.pushTask(t)
+	}
+	notify(s.taskNotify)
+}
+func (s *PriorityScheduler) pushTask(t *Task) {
+	heap.Push(&s.tasks, priorityTask{task: t, priority: taskPriority(t), seq: s.seq})
+	s.seq += 1
+}
+func (s *PriorityScheduler) AddItem(i interface{}) {
+	s.base.AddItem(i)
+}
+func (s *PriorityScheduler) IsTaskEmpty() bool {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	return s.tasks.Len() == 0 && s.delayed.Len() == 0
+}
+func (s *PriorityScheduler) NextTaskTime() (time.Time, bool) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	if s.tasks.Len() > 0 {
+		return time.Time{}, false
+	}
+	return s.delayed.next()
+}
+func (s *PriorityScheduler) IsItemEmpty() bool {
+	return s.base.IsItemEmpty()
+}
+func (s *PriorityScheduler) TaskNotify() <-chan struct{} {
+	return s.taskNotify
+}
+func (s *PriorityScheduler) ItemNotify() <-chan struct{} {
+	return s.base.ItemNotify()
+}
+
+// HostScheduler is a scheduler keeps a queue for each host and pops tasks from the hosts in turn,
+// so a host with lots of tasks won't starve the others.
+// Hosts which are not ready, e.g. whose Limiter delay has not passed, are skipped.
+type HostScheduler struct {
+	tasksLock  sync.Mutex
+	queues     map[string][]*Task
+	delayed    delayQueue
+	hosts      []string
+	next       int
+	served     int
+	weights    map[string]int
+	count      int
+	ready      []func(u *url.URL) bool
+	taskNotify chan struct{}
+	base       *BaseScheduler
+}
+
+func NewHostScheduler() *HostScheduler {
+	return &HostScheduler{
+		queues:     map[string][]*Task{},
+		weights:    map[string]int{},
+		taskNotify: make(chan struct{}, 1),
+		base:       NewBaseScheduler(false),
+	}
+}
+
+// SetHostWeight sets how many tasks of the host could be popped in one turn, default is 1
+func (s *HostScheduler) SetHostWeight(host string, weight int) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	s.weights[strings.ToLower(host)] = weight
+}
+
+// AddReadyChecker adds a function to check whether a request to the url could be sent now.
+// Limiter adds its checker automatically if the spider is using HostScheduler when the Limiter is used.
+func (s *HostScheduler) AddReadyChecker(fn func(u *url.URL) bool) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	s.ready = append(s.ready, fn)
+}
+
+func (s *HostScheduler) isReady(u *url.URL) bool {
+	for _, fn := range s.ready {
+		if !fn(u) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *HostScheduler) GetTask() *Task {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	now := time.Now()
+	for {
+		t, ok := s.delayed.pop(now)
+		if !ok {
+			break
+		}
+		s.pushTask(t.(*Task))
+	}
+	for i := 0; i < len(s.hosts); i++ {
+		idx := (s.next + i) % len(s.hosts)
+		host := s.hosts[idx]
+		q := s.queues[host]
+		if !s.isReady(q[0].Request.URL) {
+			continue
+		}
+		t := q[0]
+		q[0] = nil
+		q = q[1:]
+		s.count -= 1
+		if idx != s.next {
+			s.next, s.served = idx, 0
+		}
+		s.served += 1
+		weight := s.weights[host]
+		if weight < 1 {
+			weight = 1
+		}
+		if len(q) == 0 {
+			delete(s.queues, host)
+			s.hosts = append(s.hosts[:idx], s.hosts[idx+1:]...)
+			s.served = 0
+		} else {
+			s.queues[host] = q
+			if s.served >= weight {
+				s.next, s.served = idx+1, 0
+			}
+		}
+		if len(s.hosts) > 0 {
+			s.next %= len(s.hosts)
+		} else {
+			s.next = 0
+		}
+		return t
+	}
+	return nil
+}
+func (s *HostScheduler) GetItem() interface{} {
+	return s.base.GetItem()
+}
+func (s *HostScheduler) AddTask(t *Task) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	if isDelayed(t, time.Now()) {
+		s.delayed.push(t.Request.NotBefore, t)
+	} else {
+		s.pushTask(t)
+	}
+	notify(s.taskNotify)
+}
+func (s *HostScheduler) pushTask(t *Task) {
+	host := NormalizeHost(t.Request.URL)
+	if _, ok := s.queues[host]; !ok {
+		s.hosts = append(s.hosts, host)
+	}
+	s.queues[host] = append(s.queues[host], t)
+	s.count += 1
+}
+func (s *HostScheduler) AddItem(i interface{}) {
+	s.base.AddItem(i)
+}
+func (s *HostScheduler) IsTaskEmpty() bool {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	return s.count == 0 && s.delayed.Len() == 0
+}
+
+// NextTaskTime returns false if some tasks are queued but their hosts are not ready, they are found by polling.
+func (s *HostScheduler) NextTaskTime() (time.Time, bool) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+	if s.count > 0 {
+		return time.Time{}, false
+	}
+	return s.delayed.next()
+}
+func (s *HostScheduler) IsItemEmpty() bool {
+	return s.base.IsItemEmpty()
+}
+
+// TaskNotify notifies the new tasks.Tasks of the hosts becoming ready are found by polling.
+func (s *HostScheduler) TaskNotify() <-chan struct{} {
+	return s.taskNotify
+}
+func (s *HostScheduler) ItemNotify() <-chan struct{} {
+	return s.base.ItemNotify()
+}
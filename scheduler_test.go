@@ -0,0 +1,190 @@
+package goribot
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerConcurrent(t *testing.T) {
+	const workers, each = 8, 500
+	for name, s := range map[string]Scheduler{
+		"BaseScheduler":     NewBaseScheduler(false),
+		"DepthFirst":        NewBaseScheduler(true),
+		"PriorityScheduler": NewPriorityScheduler(),
+		"HostScheduler":     NewHostScheduler(),
+	} {
+		var gotTasks, gotItems int64
+		seen := sync.Map{}
+		wg := sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < each; i++ {
+					s.AddTask(NewTask(GetReq(fmt.Sprintf("http://host%d.com/%d", w%3, i)).WithMeta("id", w*each+i)))
+					s.AddItem(w*each + i)
+				}
+			}(w)
+			go func() {
+				defer wg.Done()
+				for atomic.LoadInt64(&gotTasks) < workers*each || atomic.LoadInt64(&gotItems) < workers*each {
+					if task := s.GetTask(); task != nil {
+						if _, dup := seen.LoadOrStore(task.Request.Meta["id"], struct{}{}); dup {
+							t.Error(name, "got task twice", task.Request.Meta["id"])
+						}
+						atomic.AddInt64(&gotTasks, 1)
+					}
+					if s.GetItem() != nil {
+						atomic.AddInt64(&gotItems, 1)
+					}
+					_ = s.IsTaskEmpty()
+					_ = s.IsItemEmpty()
+				}
+			}()
+		}
+		wg.Wait()
+		if gotTasks != workers*each || gotItems != workers*each || !s.IsTaskEmpty() || !s.IsItemEmpty() {
+			t.Error(name, "lost tasks or items", gotTasks, gotItems)
+		}
+	}
+}
+
+func TestPriorityScheduler(t *testing.T) {
+	s := NewPriorityScheduler()
+	add := func(name string, depth, priority int) {
+		req := GetReq("http://example.com/" + name).SetPriority(priority)
+		req.Depth = depth
+		s.AddTask(NewTask(req.WithMeta("name", name)))
+	}
+	add("list1", 1, 0)
+	add("detail1", 2, 0)
+	add("list2", 1, 0)
+	add("urgent", 1, 10)
+	add("detail2", 2, 0)
+	add("low", 3, -1)
+
+	var got []string
+	for !s.IsTaskEmpty() {
+		got = append(got, s.GetTask().Request.Meta["name"].(string))
+	}
+	if fmt.Sprint(got) != "[urgent detail1 detail2 list1 list2 low]" {
+		t.Error("wrong task order", got)
+	}
+	if s.GetTask() != nil {
+		t.Error("got task from empty scheduler")
+	}
+}
+
+func TestHostScheduler(t *testing.T) {
+	s := NewHostScheduler()
+	for _, u := range []string{"a/1", "a/2", "a/3", "a/4", "b/1", "c/1", "c/2"} {
+		s.AddTask(NewTask(GetReq("http://" + u)))
+	}
+	s.SetHostWeight("c", 2)
+	blockB := true
+	s.AddReadyChecker(func(u *url.URL) bool {
+		return !(blockB && u.Host == "b")
+	})
+	pop := func() string {
+		task := s.GetTask()
+		if task == nil {
+			return "nil"
+		}
+		return task.Request.URL.Host + task.Request.URL.Path
+	}
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, pop())
+	}
+	blockB = false
+	for !s.IsTaskEmpty() {
+		got = append(got, pop())
+	}
+	if fmt.Sprint(got) != "[a/1 c/1 c/2 a/2 a/3 b/1 a/4]" {
+		t.Error("wrong task order", got)
+	}
+	if s.GetTask() != nil {
+		t.Error("got task from empty scheduler")
+	}
+}
+
+func TestSchedulerDelay(t *testing.T) {
+	for name, s := range map[string]Scheduler{
+		"base":     NewBaseScheduler(false),
+		"priority": NewPriorityScheduler(),
+		"host":     NewHostScheduler(),
+	} {
+		s.AddTask(NewTask(Get("http://example.com/later").SetDelay(100 * time.Millisecond)))
+		s.AddTask(NewTask(Get("http://example.com/past").SetNotBefore(time.Now().Add(-time.Second))))
+		s.AddTask(NewTask(Get("http://example.com/now")))
+		if _, ok := s.(DelayScheduler).NextTaskTime(); ok {
+			t.Error(name, "reported next task time with ready tasks")
+		}
+		var got []string
+		for i := 0; i < 2; i++ {
+			if task := s.GetTask(); task != nil {
+				got = append(got, task.Request.URL.Path)
+			}
+		}
+		if len(got) != 2 || s.GetTask() != nil || s.IsTaskEmpty() {
+			t.Error(name, "delayed task is popped early", got)
+		}
+		if at, ok := s.(DelayScheduler).NextTaskTime(); !ok || time.Until(at) <= 0 || time.Until(at) > 100*time.Millisecond {
+			t.Error(name, "wrong next task time", at, ok)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if task := s.GetTask(); task == nil || task.Request.URL.Path != "/later" {
+			t.Error(name, "lost delayed task")
+		}
+		if !s.IsTaskEmpty() {
+			t.Error(name, "too many tasks")
+		}
+	}
+
+	var got int64
+	start := time.Now()
+	sp := NewSpider()
+	sp.AddTask(Get("http://127.0.0.1:1/").SetDelay(200*time.Millisecond), func(ctx *Context) {})
+	sp.OnError(func(ctx *Context, err error) {
+		if time.Since(start) < 200*time.Millisecond {
+			t.Error("delayed task is sent early")
+		}
+		atomic.AddInt64(&got, 1)
+	})
+	sp.Run()
+	if atomic.LoadInt64(&got) != 1 {
+		t.Error("spider didn't wait for delayed task")
+	}
+}
+
+type countScheduler struct {
+	*BaseScheduler
+	gets int64
+}
+
+func (s *countScheduler) GetTask() *Task {
+	atomic.AddInt64(&s.gets, 1)
+	return s.BaseScheduler.GetTask()
+}
+
+func TestSchedulerDelayWait(t *testing.T) {
+	s := &countScheduler{BaseScheduler: NewBaseScheduler(false)}
+	var got int64
+	sp := NewSpider()
+	sp.Scheduler = s
+	sp.AddTask(Get("http://127.0.0.1:1/").SetDelay(300*time.Millisecond), func(ctx *Context) {})
+	sp.OnError(func(ctx *Context, err error) {
+		atomic.AddInt64(&got, 1)
+	})
+	sp.Run()
+	if atomic.LoadInt64(&got) != 1 {
+		t.Error("spider didn't wait for delayed task")
+	}
+	if n := atomic.LoadInt64(&s.gets); n > 10 {
+		t.Error("spider polled the scheduler while waiting for delayed task", n)
+	}
+}
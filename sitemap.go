@@ -0,0 +1,328 @@
+package goribot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/net/html/charset"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSitemapSize is the max size of uncompressed sitemap, it's 50MB by the protocol and some more for tolerance
+const maxSitemapSize = 100 << 20
+
+// maxSitemapDepth is the max depth of nested sitemap indexes
+const maxSitemapDepth = 5
+
+// SitemapURL is an url entry of sitemap
+type SitemapURL struct {
+	Loc string
+	// LastMod is zero if it's unknown
+	LastMod    time.Time
+	ChangeFreq string
+	// Priority is 0.5 if it's unknown
+	Priority float64
+}
+
+// Sitemap is the parsed content of a sitemap
+type Sitemap struct {
+	// URLs are the pages of urlset, RSS, Atom or text sitemap
+	URLs []SitemapURL
+	// Sitemaps are the sub sitemaps of sitemap index
+	Sitemaps []SitemapURL
+}
+
+type xmlSitemap struct {
+	XMLName  xml.Name
+	URLs     []xmlSitemapURL `xml:"url"`
+	Sitemaps []xmlSitemapURL `xml:"sitemap"`
+	Items    []struct {
+		Link    string `xml:"link"`
+		GUID    string `xml:"guid"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+	} `xml:"entry"`
+}
+
+type xmlSitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+func (u xmlSitemapURL) parse() SitemapURL {
+	res := SitemapURL{
+		Loc:        strings.TrimSpace(u.Loc),
+		LastMod:    parseSitemapTime(u.LastMod),
+		ChangeFreq: strings.TrimSpace(u.ChangeFreq),
+		Priority:   0.5,
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil {
+		res.Priority = p
+	}
+	return res
+}
+
+// sitemapTimeLayouts are the W3C datetime layouts of sitemaps and the date layouts of RSS and Atom
+var sitemapTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+}
+
+// parseSitemapTime returns zero time if s is empty or bad
+func parseSitemapTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range sitemapTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ParseSitemap parses the sitemap of xml urlset, sitemap index, RSS, Atom or plain text with an url per line.
+// The gzip compressed content is uncompressed.
+func ParseSitemap(body []byte) (*Sitemap, error) {
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(&limitedReader{R: gz, N: maxSitemapSize})
+		_ = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if !bytes.HasPrefix(trimmed, []byte("<")) {
+		return parseTextSitemap(trimmed), nil
+	}
+
+	x := xmlSitemap{}
+	d := xml.NewDecoder(bytes.NewReader(trimmed))
+	d.CharsetReader = charset.NewReaderLabel
+	if err := d.Decode(&x); err != nil {
+		return nil, err
+	}
+	res := &Sitemap{}
+	for _, u := range x.URLs {
+		if s := u.parse(); s.Loc != "" {
+			res.URLs = append(res.URLs, s)
+		}
+	}
+	for _, u := range x.Sitemaps {
+		if s := u.parse(); s.Loc != "" {
+			res.Sitemaps = append(res.Sitemaps, s)
+		}
+	}
+	for _, i := range x.Items {
+		loc := strings.TrimSpace(i.Link)
+		if loc == "" && strings.HasPrefix(strings.TrimSpace(i.GUID), "http") {
+			loc = strings.TrimSpace(i.GUID)
+		}
+		if loc != "" {
+			res.URLs = append(res.URLs, SitemapURL{Loc: loc, LastMod: parseSitemapTime(i.PubDate), Priority: 0.5})
+		}
+	}
+	for _, e := range x.Entries {
+		loc := ""
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				loc = strings.TrimSpace(l.Href)
+				break
+			}
+		}
+		if loc == "" {
+			continue
+		}
+		lastMod := parseSitemapTime(e.Updated)
+		if lastMod.IsZero() {
+			lastMod = parseSitemapTime(e.Published)
+		}
+		res.URLs = append(res.URLs, SitemapURL{Loc: loc, LastMod: lastMod, Priority: 0.5})
+	}
+	return res, nil
+}
+
+func parseTextSitemap(body []byte) *Sitemap {
+	res := &Sitemap{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			res.URLs = append(res.URLs, SitemapURL{Loc: line, Priority: 0.5})
+		}
+	}
+	return res
+}
+
+// ParseRobotsSitemaps returns the urls of "Sitemap:" lines in robots.txt
+func ParseRobotsSitemaps(body []byte) []string {
+	var res []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "sitemap") {
+			if u := strings.TrimSpace(line[i+1:]); u != "" {
+				res = append(res, u)
+			}
+		}
+	}
+	return res
+}
+
+// limitedReader is like io.LimitedReader but fails with ErrBodyTooLarge when the limit is exceeded
+type limitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.N <= 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > l.N {
+		p = p[:l.N]
+	}
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	return n, err
+}
+
+// SitemapHandlerName is the name of the handler registered by Sitemaps for the sitemap tasks,
+// so they could be persisted by DiskScheduler or shared by RedisScheduler.
+// The Sitemaps used again in a spider registers "goribot.Sitemaps#2" and so on.
+const SitemapHandlerName = "goribot.Sitemaps"
+
+// Sitemaps is an extension crawls the pages in sitemaps at start.
+// urls are the urls of sitemaps, sitemap indexes, RSS or Atom feeds, or robots.txt whose "Sitemap:" lines are used,
+// and the sub sitemaps of sitemap indexes are crawled as well.
+// The pages whose lastmod is before since are skipped, zero since means all pages.
+// A page is added as a task by the first rule whose Extractor matches it, and the patterns of Extractor are used only.
+// No rule means all pages without handlers.
+func Sitemaps(urls []string, since time.Time, rules ...*LinkRule) func(s *Spider) {
+	for _, r := range rules {
+		if r.Extractor == nil {
+			r.Extractor = &LinkExtractor{}
+		}
+		if err := r.Extractor.compile(); err != nil {
+			panic(err)
+		}
+	}
+	lock := sync.Mutex{}
+	seen := map[string]struct{}{}
+	return func(s *Spider) {
+		name := SitemapHandlerName
+		for i := 2; s.namedHandlers[name] != nil; i++ {
+			name = fmt.Sprint(SitemapHandlerName, "#", i)
+		}
+		addSitemap := func(add func(req *Request, names ...string), u string, depth int) {
+			lock.Lock()
+			_, ok := seen[u]
+			seen[u] = struct{}{}
+			lock.Unlock()
+			if ok {
+				return
+			}
+			req := Get(u).WithMeta("Sitemap", depth).WithMeta("LinkFollow", false)
+			add(req, name)
+		}
+		addPage := func(ctx *Context, u *url.URL) {
+			if len(rules) == 0 {
+				ctx.AddTask(Get(u.String()))
+				return
+			}
+			for _, r := range rules {
+				link := u
+				if r.Extractor.Normalizer != nil {
+					link = r.Extractor.Normalizer.Normalize(u)
+				}
+				if !r.Extractor.Match(link) {
+					continue
+				}
+				req := Get(link.String()).WithMeta("LinkFollow", r.Follow)
+				if len(r.Handlers) == 0 && len(r.HandlerNames) > 0 {
+					ctx.AddTaskByName(req, r.HandlerNames...)
+				} else {
+					ctx.AddTask(req, r.Handlers...)
+				}
+				return
+			}
+		}
+		s.RegisterHandler(name, func(ctx *Context) {
+			depth, _ := ctx.Req.Meta["Sitemap"].(int)
+			body := ctx.Resp.RawBody
+			if len(body) == 0 {
+				body = ctx.Resp.Body
+			}
+			if strings.EqualFold(ctx.Req.URL.Path, "/robots.txt") {
+				for _, u := range ParseRobotsSitemaps(body) {
+					addSitemap(ctx.AddTaskByName, u, depth)
+				}
+				return
+			}
+			sitemap, err := ParseSitemap(body)
+			if err != nil {
+				Log.Error("parse sitemap", ctx.Req.URL, "error", err)
+				return
+			}
+			for _, sub := range sitemap.Sitemaps {
+				if depth >= maxSitemapDepth {
+					Log.Warning("Sitemap index", ctx.Req.URL, "is nested too deep")
+					break
+				}
+				if !since.IsZero() && !sub.LastMod.IsZero() && sub.LastMod.Before(since) {
+					continue
+				}
+				if u, err := ctx.Req.URL.Parse(sub.Loc); err == nil {
+					addSitemap(ctx.AddTaskByName, u.String(), depth+1)
+				}
+			}
+			for _, page := range sitemap.URLs {
+				if !since.IsZero() && !page.LastMod.IsZero() && page.LastMod.Before(since) {
+					continue
+				}
+				u, err := ctx.Req.URL.Parse(page.Loc)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					continue
+				}
+				addPage(ctx, u)
+			}
+		})
+		s.OnStart(func(s *Spider) {
+			for _, u := range urls {
+				addSitemap(s.AddTaskByName, u, 0)
+			}
+		})
+	}
+}
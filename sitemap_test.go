@@ -0,0 +1,160 @@
+package goribot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSitemap(t *testing.T) {
+	urlset := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc> http://example.com/a </loc><lastmod>2020-01-02</lastmod><changefreq>daily</changefreq><priority>0.8</priority></url>
+	<url><loc>http://example.com/b</loc><lastmod>2020-01-02T10:00:00+08:00</lastmod></url>
+	<url><loc></loc></url>
+</urlset>`
+	sm, err := ParseSitemap([]byte(urlset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.URLs) != 2 || sm.URLs[0].Loc != "http://example.com/a" || sm.URLs[0].Priority != 0.8 || sm.URLs[0].ChangeFreq != "daily" ||
+		!sm.URLs[0].LastMod.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)) ||
+		!sm.URLs[1].LastMod.Equal(time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC)) || sm.URLs[1].Priority != 0.5 {
+		t.Errorf("wrong urlset %+v", sm)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><sitemap><loc>http://example.com/s1.xml</loc><lastmod>2019-12-01</lastmod></sitemap><sitemap><loc>/s2.xml</loc></sitemap></sitemapindex>`))
+	_ = w.Close()
+	sm, err = ParseSitemap(gz.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.URLs) != 0 || len(sm.Sitemaps) != 2 || sm.Sitemaps[1].Loc != "/s2.xml" || sm.Sitemaps[0].LastMod.Year() != 2019 {
+		t.Errorf("wrong sitemap index %+v", sm)
+	}
+
+	rss := `<?xml version="1.0" encoding="ISO-8859-1"?><rss version="2.0"><channel><title>caf` + "\xe9" + `</title>
+<item><link>http://example.com/post/1</link><pubDate>Mon, 06 Jan 2020 15:04:05 +0000</pubDate></item>
+<item><guid>http://example.com/post/2</guid></item></channel></rss>`
+	sm, err = ParseSitemap([]byte(rss))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.URLs) != 2 || sm.URLs[0].LastMod.Day() != 6 || sm.URLs[1].Loc != "http://example.com/post/2" {
+		t.Errorf("wrong rss %+v", sm)
+	}
+
+	atom := `<feed xmlns="http://www.w3.org/2005/Atom"><entry><link rel="self" href="http://example.com/self"/><link href="http://example.com/entry/1"/><updated>2020-02-03T04:05:06Z</updated></entry></feed>`
+	sm, err = ParseSitemap([]byte(atom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.URLs) != 1 || sm.URLs[0].Loc != "http://example.com/entry/1" || sm.URLs[0].LastMod.Month() != 2 {
+		t.Errorf("wrong atom %+v", sm)
+	}
+
+	sm, err = ParseSitemap([]byte("\xef\xbb\xbfhttp://example.com/1\n\n  https://example.com/2  \nnot an url\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.URLs) != 2 || sm.URLs[1].Loc != "https://example.com/2" {
+		t.Errorf("wrong text sitemap %+v", sm)
+	}
+
+	if _, err = ParseSitemap([]byte("<urlset><url>")); err == nil {
+		t.Error("no error for bad xml")
+	}
+
+	robots := "User-agent: *\nDisallow: /private\nSitemap: http://example.com/sitemap.xml\nsitemap:http://example.com/news.xml\n"
+	if res := ParseRobotsSitemaps([]byte(robots)); strings.Join(res, " ") != "http://example.com/sitemap.xml http://example.com/news.xml" {
+		t.Error("wrong sitemaps of robots.txt", res)
+	}
+}
+
+func TestSitemaps(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nSitemap: %s/index.xml\n", ts.URL)
+		case "/index.xml":
+			fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s/pages.xml.gz</loc></sitemap><sitemap><loc>/old.xml</loc><lastmod>2019-01-01</lastmod></sitemap><sitemap><loc>/index.xml</loc></sitemap></sitemapindex>`, ts.URL)
+		case "/pages.xml.gz":
+			gz := gzip.NewWriter(w)
+			fmt.Fprintf(gz, `<urlset><url><loc>%[1]s/item/1</loc><lastmod>2020-06-01</lastmod></url><url><loc>%[1]s/item/2</loc><lastmod>2019-06-01</lastmod></url><url><loc>%[1]s/list/1</loc></url><url><loc>%[1]s/about</loc></url></urlset>`, ts.URL)
+			_ = gz.Close()
+		case "/old.xml":
+			t.Error("old sitemap is requested")
+		case "/feed.txt":
+			fmt.Fprintf(w, "%s/item/3\n", ts.URL)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/item/4">item</a>`)
+		}
+	}))
+	defer ts.Close()
+
+	lock := sync.Mutex{}
+	var items []string
+	lists := 0
+	s := NewSpider(
+		Sitemaps(
+			[]string{ts.URL + "/robots.txt", ts.URL + "/feed.txt"},
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			&LinkRule{
+				Extractor: &LinkExtractor{Allow: []string{`/item/\d+$`}},
+				Handlers: []CtxHandlerFun{func(ctx *Context) {
+					lock.Lock()
+					items = append(items, ctx.Req.URL.Path)
+					lock.Unlock()
+				}},
+			},
+			&LinkRule{
+				Extractor: &LinkExtractor{AllowGlobs: []string{"*/list/*"}},
+				Handlers: []CtxHandlerFun{func(ctx *Context) {
+					lock.Lock()
+					lists += 1
+					lock.Unlock()
+				}},
+				Follow: true,
+			},
+		),
+		Rules(&LinkRule{Handlers: []CtxHandlerFun{func(ctx *Context) {
+			lock.Lock()
+			items = append(items, ctx.Req.URL.Path)
+			lock.Unlock()
+		}}}),
+	)
+	sitemaps := 0
+	s.OnAdd(func(ctx *Context, task *Task) *Task {
+		if _, ok := task.Request.Meta["Sitemap"]; ok {
+			if _, err := encodeTask(task); err != nil || len(task.Handlers) != 0 || len(task.HandlerNames) != 1 || task.HandlerNames[0] != SitemapHandlerName {
+				t.Error("sitemap task can't be persisted", err, task.HandlerNames)
+			}
+			lock.Lock()
+			sitemaps += 1
+			lock.Unlock()
+		}
+		return task
+	})
+	s.Run()
+
+	sort.Strings(items)
+	if strings.Join(items, " ") != "/item/1 /item/3 /item/4" || lists != 1 || sitemaps != 4 {
+		t.Error("wrong crawled pages", items, lists, sitemaps)
+	}
+
+	s = NewSpider(Sitemaps(nil, time.Time{}), Sitemaps(nil, time.Time{}))
+	if _, ok := s.namedHandlers[SitemapHandlerName+"#2"]; !ok {
+		t.Error("second sitemap handler isn't registered")
+	}
+}
@@ -0,0 +1,330 @@
+package goribot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of latency histograms in Stats
+var LatencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Kinds of errors counted in Stats.Errors
+const (
+	ErrKindCanceled        = "canceled"
+	ErrKindTimeout         = "timeout"
+	ErrKindDownload        = "download"
+	ErrKindHandlerNotFound = "handler_not_found"
+	ErrKindOther           = "other"
+)
+
+// LatencyHistogram is a histogram of latencies
+type LatencyHistogram struct {
+	// Buckets are the upper bounds of buckets
+	Buckets []time.Duration
+	// Counts[i] is the number of latencies in (Buckets[i-1],Buckets[i]],
+	// the last one counts the latencies greater than all the buckets.
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		Buckets: LatencyBuckets,
+		Counts:  make([]int64, len(LatencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(h.Buckets), func(i int) bool { return d <= h.Buckets[i] })
+	h.Counts[i] += 1
+	h.Count += 1
+	h.Sum += d
+}
+
+func (h *LatencyHistogram) copy() LatencyHistogram {
+	c := *h
+	c.Counts = append([]int64(nil), h.Counts...)
+	return c
+}
+
+// Mean returns the average latency
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Stats is a snapshot of the crawl statistics of a spider
+type Stats struct {
+	Start    time.Time
+	Duration time.Duration
+	// Requests is the number of requests sent by Downloader
+	Requests int64
+	// Responses is the number of responses got without error
+	Responses int64
+	// Bytes is the size of response bodies
+	Bytes int64
+	// Retries is the number of requests retried by Retry extension
+	Retries int64
+	// Deduplicated is the number of tasks dropped by deduplicate extensions
+	Deduplicated int64
+	// Limited is the number of tasks dropped by Limiter
+	Limited int64
+	// TasksAdded and TasksTaken are the number of tasks added to and taken from Scheduler by this spider
+	TasksAdded, TasksTaken int64
+	// QueueDepth is TasksAdded-TasksTaken.
+	// It's only an estimate for schedulers shared by spiders,like RedisScheduler.
+	QueueDepth int64
+	// RunningTasks and RunningItems are the number of tasks and items being handled
+	RunningTasks, RunningItems int64
+	// ItemsAdded is the number of items added by handlers,Items is the number of items handled by OnItem handlers
+	ItemsAdded, Items int64
+	StatusCodes       map[int]int64
+	// Errors are the number of errors passed to OnError handlers by kind
+	Errors map[string]int64
+	// HostLatency are the histograms of download latency by host
+	HostLatency map[string]LatencyHistogram
+	// HandlerLatency is the histogram of time spent in the handlers of tasks
+	HandlerLatency LatencyHistogram
+}
+
+// String returns a readable summary of stats
+func (s Stats) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Crawled %d requests in %s: %d responses,%d bytes,%d retries,%d items\n",
+		s.Requests, s.Duration.Round(time.Millisecond), s.Responses, s.Bytes, s.Retries, s.Items)
+	fmt.Fprintf(b, "Tasks: %d added,%d taken,%d queued,%d deduplicated,%d limited\n",
+		s.TasksAdded, s.TasksTaken, s.QueueDepth, s.Deduplicated, s.Limited)
+	codes := make([]int, 0, len(s.StatusCodes))
+	for c := range s.StatusCodes {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	b.WriteString("Status codes:")
+	for _, c := range codes {
+		fmt.Fprintf(b, " %d=%d", c, s.StatusCodes[c])
+	}
+	kinds := make([]string, 0, len(s.Errors))
+	for k := range s.Errors {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	b.WriteString("\nErrors:")
+	for _, k := range kinds {
+		fmt.Fprintf(b, " %s=%d", k, s.Errors[k])
+	}
+	hosts := make([]string, 0, len(s.HostLatency))
+	for h := range s.HostLatency {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		fmt.Fprintf(b, "\nHost %s: %d requests,mean latency %s", h, s.HostLatency[h].Count, s.HostLatency[h].Mean().Round(time.Microsecond))
+	}
+	fmt.Fprintf(b, "\nHandlers: mean latency %s", s.HandlerLatency.Mean().Round(time.Microsecond))
+	return b.String()
+}
+
+// stats collects the statistics of a spider, it's safe for concurrent use
+type stats struct {
+	requests, responses, bytes, retries int64
+	deduplicated, limited               int64
+	tasksAdded, tasksTaken              int64
+	itemsAdded, items                   int64
+	lock                                sync.Mutex
+	start, finish                       time.Time
+	statusCodes                         map[int]int64
+	errors                              map[string]int64
+	hostLatency                         map[string]*LatencyHistogram
+	handlerLatency                      *LatencyHistogram
+}
+
+func newStats() *stats {
+	return &stats{
+		statusCodes:    map[int]int64{},
+		errors:         map[string]int64{},
+		hostLatency:    map[string]*LatencyHistogram{},
+		handlerLatency: newLatencyHistogram(),
+	}
+}
+
+func (s *stats) started() {
+	s.lock.Lock()
+	s.start = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *stats) finished() {
+	s.lock.Lock()
+	s.finish = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *stats) request() {
+	atomic.AddInt64(&s.requests, 1)
+}
+
+func (s *stats) response(host string, code int, size int, latency time.Duration) {
+	atomic.AddInt64(&s.responses, 1)
+	atomic.AddInt64(&s.bytes, int64(size))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCodes[code] += 1
+	s.observeHost(host, latency)
+}
+
+// failed records the latency of a request without response
+func (s *stats) failed(host string, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.observeHost(host, latency)
+}
+
+func (s *stats) observeHost(host string, latency time.Duration) {
+	h, ok := s.hostLatency[host]
+	if !ok {
+		h = newLatencyHistogram()
+		s.hostLatency[host] = h
+	}
+	h.observe(latency)
+}
+
+func (s *stats) handled(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlerLatency.observe(latency)
+}
+
+func (s *stats) error(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors[errorKind(err)] += 1
+}
+
+// streamed adds the size of a streaming response body
+func (s *stats) streamed(n int64) {
+	atomic.AddInt64(&s.bytes, n)
+}
+
+func (s *stats) retry() {
+	atomic.AddInt64(&s.retries, 1)
+}
+
+func (s *stats) deduplicate() {
+	atomic.AddInt64(&s.deduplicated, 1)
+}
+
+func (s *stats) limit() {
+	atomic.AddInt64(&s.limited, 1)
+}
+
+func (s *stats) taskAdded() {
+	atomic.AddInt64(&s.tasksAdded, 1)
+}
+
+func (s *stats) taskTaken() {
+	atomic.AddInt64(&s.tasksTaken, 1)
+}
+
+func (s *stats) itemAdded() {
+	atomic.AddInt64(&s.itemsAdded, 1)
+}
+
+func (s *stats) item() {
+	atomic.AddInt64(&s.items, 1)
+}
+
+func (s *stats) snapshot() Stats {
+	res := Stats{
+		Requests:     atomic.LoadInt64(&s.requests),
+		Responses:    atomic.LoadInt64(&s.responses),
+		Bytes:        atomic.LoadInt64(&s.bytes),
+		Retries:      atomic.LoadInt64(&s.retries),
+		Deduplicated: atomic.LoadInt64(&s.deduplicated),
+		Limited:      atomic.LoadInt64(&s.limited),
+		TasksAdded:   atomic.LoadInt64(&s.tasksAdded),
+		TasksTaken:   atomic.LoadInt64(&s.tasksTaken),
+		ItemsAdded:   atomic.LoadInt64(&s.itemsAdded),
+		Items:        atomic.LoadInt64(&s.items),
+		StatusCodes:  map[int]int64{},
+		Errors:       map[string]int64{},
+		HostLatency:  map[string]LatencyHistogram{},
+	}
+	if res.TasksAdded > res.TasksTaken {
+		res.QueueDepth = res.TasksAdded - res.TasksTaken
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res.Start = s.start
+	if !s.start.IsZero() {
+		if s.finish.IsZero() {
+			res.Duration = time.Since(s.start)
+		} else {
+			res.Duration = s.finish.Sub(s.start)
+		}
+	}
+	for k, v := range s.statusCodes {
+		res.StatusCodes[k] = v
+	}
+	for k, v := range s.errors {
+		res.Errors[k] = v
+	}
+	for k, v := range s.hostLatency {
+		res.HostLatency[k] = v.copy()
+	}
+	res.HandlerLatency = s.handlerLatency.copy()
+	return res
+}
+
+// countReadCloser counts the bytes read
+type countReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return
+}
+
+// errorKind returns the kind of err used in Stats.Errors
+func errorKind(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return ErrKindCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrKindTimeout
+	}
+	if errors.Is(err, ErrHandlerNotFound) {
+		return ErrKindHandlerNotFound
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrKindTimeout
+	}
+	var de DownloaderErr
+	if errors.As(err, &de) {
+		return ErrKindDownload
+	}
+	return ErrKindOther
+}
@@ -0,0 +1,84 @@
+package goribot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = fmt.Fprintf(w, "Hello goribot")
+	}))
+	defer ts.Close()
+
+	s := NewSpider(
+		ReqDeduplicate(),
+		Limiter(false, &LimitRule{
+			Glob:  "127.0.0.1:*",
+			Allow: Allow,
+		}, &LimitRule{
+			Glob:  "disallowed.com",
+			Allow: Disallow,
+		}),
+	)
+	s.AddTask(GetReq(ts.URL), func(ctx *Context) {
+		ctx.AddItem(ctx.Resp.Text)
+		ctx.AddTask(GetReq("/404"))
+		ctx.AddTask(GetReq(ts.URL)) // deduplicated
+		ctx.AddTask(GetReq("http://disallowed.com/"))
+	})
+	s.AddTask(GetReq("http://127.0.0.1:1/")) // connection refused
+	s.Run()
+
+	st := s.Stats()
+	if st.Requests != 3 || st.Responses != 2 || st.Bytes != int64(2*len("Hello goribot")) {
+		t.Error("wrong request stats", st.Requests, st.Responses, st.Bytes)
+	}
+	if st.StatusCodes[http.StatusOK] != 1 || st.StatusCodes[http.StatusNotFound] != 1 {
+		t.Error("wrong status codes", st.StatusCodes)
+	}
+	if st.Errors[ErrKindDownload] != 1 {
+		t.Error("wrong errors", st.Errors)
+	}
+	if st.Deduplicated != 1 || st.Limited != 1 {
+		t.Error("wrong dropped tasks", st.Deduplicated, st.Limited)
+	}
+	if st.TasksAdded != 3 || st.TasksTaken != 3 || st.QueueDepth != 0 || st.RunningTasks != 0 {
+		t.Error("wrong task stats", st.TasksAdded, st.TasksTaken, st.QueueDepth, st.RunningTasks)
+	}
+	if st.ItemsAdded != 1 || st.Items != 1 {
+		t.Error("wrong item stats", st.ItemsAdded, st.Items)
+	}
+	host := ts.Listener.Addr().String()
+	if h := st.HostLatency[host]; h.Count != 2 || len(h.Counts) != len(LatencyBuckets)+1 {
+		t.Error("wrong host latency", st.HostLatency)
+	}
+	if st.HandlerLatency.Count != 2 {
+		t.Error("wrong handler latency", st.HandlerLatency)
+	}
+	if st.Duration <= 0 || st.Start.IsZero() {
+		t.Error("wrong duration", st.Start, st.Duration)
+	}
+	t.Log(st)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	for _, d := range []time.Duration{time.Millisecond, 50 * time.Millisecond, 60 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+	c := h.copy()
+	h.observe(time.Millisecond)
+	if c.Counts[0] != 2 || c.Counts[1] != 1 || c.Counts[len(c.Counts)-1] != 1 || c.Count != 4 {
+		t.Error("wrong histogram", c.Counts)
+	}
+	if c.Mean() != (time.Minute+111*time.Millisecond)/4 {
+		t.Error("wrong mean", c.Mean())
+	}
+}
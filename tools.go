@@ -2,12 +2,16 @@ package goribot
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"golang.org/x/net/html/charset"
 	"io/ioutil"
+	"math/rand"
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 func encodeBytes(b []byte, contentType string) ([]byte, error) {
@@ -18,7 +22,10 @@ func encodeBytes(b []byte, contentType string) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
-// GetRequestHash return a hash of url,header,cookie and body data from a request
+// GetRequestHash return a hash of url,header and cookie data from a request.
+// It's kept the same as the old versions for the hashes saved before, so the body isn't hashed
+// just like the old GetBody returned nothing.
+// Deduplicate extensions use Spider.Fingerprinter instead, which ignores headers and hashes body by default.
 func GetRequestHash(r *Request) [md5.Size]byte {
 	u := r.URL
 	UrtStr := u.Scheme + "://"
@@ -72,7 +79,52 @@ func GetRequestHash(r *Request) [md5.Size]byte {
 	CookieStr := strings.Join(Cookie, "&")
 
 	data := []byte(strings.Join([]string{UrtStr, HeaderStr, CookieStr}, "@#@"))
-	data = append(data, r.GetBody()...)
 	has := md5.Sum(data)
 	return has
 }
+
+// waitGroupTimeout waits for wg until deadline, returns false if it's timeout.A nil deadline means no timeout.
+func waitGroupTimeout(wg *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// sleepContext sleeps d like time.Sleep, but returns the error of ctx if it's done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockedRand is a *rand.Rand safe for concurrent use
+type lockedRand struct {
+	lock sync.Mutex
+	r    *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.r.Intn(n)
+}
@@ -0,0 +1,261 @@
+package goribot
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportConfig(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	d := NewBaseDownloader()
+	d.TransportConfig.Timeout = 100 * time.Millisecond
+	_, err := d.Do(Get(ts.URL + "/slow"))
+	var de DownloaderErr
+	if !errors.As(err, &de) || de.Kind() != ErrKindTimeout || !de.Timeout() {
+		t.Error("timeout isn't reported", err)
+	}
+	resp, err := d.Do(Get(ts.URL + "/slow").SetTimeout(time.Second))
+	if err != nil || resp.Text != "ok" {
+		t.Error("timeout of request doesn't work", err)
+	}
+	_, err = d.Do(Get(ts.URL + "/slow").SetTransportConfig(&TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond, DisableHTTP2: true}))
+	if !errors.As(err, &de) || !de.Timeout() {
+		t.Error("header timeout isn't reported", err)
+	}
+	if len(d.transports) != 2 {
+		t.Error("wrong cached transports", len(d.transports))
+	}
+
+	d = NewBaseDownloader()
+	_, err = d.Do(&Request{Err: errors.New("bad request"), Meta: map[string]interface{}{}})
+	if !errors.As(err, &de) || de.Error() != "bad request" {
+		t.Error("error of request isn't returned", err)
+	}
+
+	var errs int64
+	s := NewSpider(UseTransportConfig(TransportConfig{Timeout: 100 * time.Millisecond}))
+	s.OnError(func(ctx *Context, err error) {
+		if e, ok := err.(DownloaderErr); ok && e.Timeout() {
+			atomic.AddInt64(&errs, 1)
+		}
+	})
+	s.AddTask(Get(ts.URL+"/slow"), func(ctx *Context) {
+		t.Error("slow request should fail")
+	})
+	s.AddTask(Get(ts.URL+"/fast"), func(ctx *Context) {
+		if ctx.Resp.Text != "ok" {
+			t.Error("wrong response", ctx.Resp.Text)
+		}
+	})
+	s.Run()
+	if atomic.LoadInt64(&errs) != 1 {
+		t.Error("wrong timeout errors", errs)
+	}
+	if s.Stats().Errors[ErrKindTimeout] != 1 {
+		t.Error("timeout isn't counted", s.Stats().Errors)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for i := 0; i < 6; i++ {
+			_, _ = fmt.Fprint(w, i)
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/stall" && i == 2 {
+				time.Sleep(400 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	d := NewBaseDownloader()
+	d.TransportConfig.Timeout = 150 * time.Millisecond
+	d.TransportConfig.StreamIdleTimeout = 150 * time.Millisecond
+	var de DownloaderErr
+	if _, err := d.Do(Get(ts.URL + "/slow")); !errors.As(err, &de) || !de.Timeout() {
+		t.Error("timeout isn't reported", err)
+	}
+	resp, err := d.Do(Get(ts.URL + "/slow").SetStream(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.BodyReader)
+	_ = resp.CloseBody()
+	if err != nil || string(data) != "012345" {
+		t.Error("streamed body is cut by timeout", err, string(data))
+	}
+	resp, err = d.Do(Get(ts.URL + "/stall").SetStream(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.BodyReader)
+	_ = resp.CloseBody()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() || errorKind(err) != ErrKindTimeout {
+		t.Error("idle timeout isn't reported", err)
+	}
+}
+
+func TestTransportConfigMerge(t *testing.T) {
+	c := DefaultTransportConfig.merge(&TransportConfig{Timeout: time.Second, MaxIdleConnsPerHost: 8})
+	if c.Timeout != time.Second || c.MaxIdleConnsPerHost != 8 || c.ConnectTimeout != DefaultTransportConfig.ConnectTimeout {
+		t.Error("wrong merged config", c)
+	}
+	if DefaultTransportConfig.merge(nil) != DefaultTransportConfig {
+		t.Error("nil config should change nothing")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "direct")
+	}))
+	defer ts.Close()
+	var proxied int64
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&proxied, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "proxied "+r.URL.String())
+	}))
+	defer httpProxy.Close()
+	socks := newTestSocks5(t, "user", "pass")
+	defer socks.Close()
+
+	d := NewBaseDownloader()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := d.Do(Get(ts.URL).SetProxy(strings.Replace(httpProxy.URL, "http://", "http://user:pass@", 1)))
+			if err != nil || resp.Text != "proxied "+ts.URL+"/" {
+				t.Error("wrong proxied response", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := d.Do(Get(ts.URL))
+			if err != nil || resp.Text != "direct" {
+				t.Error("wrong direct response", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt64(&proxied) != 20 {
+		t.Error("wrong proxied requests", proxied)
+	}
+
+	resp, err := d.Do(Get(ts.URL).SetProxy("socks5://user:pass@" + socks.Addr().String()))
+	if err != nil || resp.Text != "direct" {
+		t.Error("wrong socks5 response", err)
+	}
+	if _, err = d.Do(Get(ts.URL).SetProxy("socks5://user:wrong@" + socks.Addr().String())); err == nil {
+		t.Error("wrong socks5 password should fail")
+	}
+	if _, err = d.Do(Get(ts.URL).SetProxy("ftp://127.0.0.1")); !errors.Is(err, ErrProxyScheme) {
+		t.Error("unsupported scheme should fail", err)
+	}
+	// direct, http proxy, socks5 proxy and socks5 proxy with wrong password
+	if len(d.transports) != 4 {
+		t.Error("wrong cached transports", len(d.transports))
+	}
+	d.CloseIdleConnections()
+}
+
+// newTestSocks5 starts a socks5 server supports CONNECT with username/password authentication
+func newTestSocks5(t *testing.T, user, pass string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 512)
+				// greeting: VER NMETHODS METHODS
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				_, _ = c.Write([]byte{5, 2})
+				// auth: VER ULEN UNAME PLEN PASSWD
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				u := make([]byte, buf[1])
+				_, _ = io.ReadFull(c, u)
+				_, _ = io.ReadFull(c, buf[:1])
+				p := make([]byte, buf[0])
+				_, _ = io.ReadFull(c, p)
+				if string(u) != user || string(p) != pass {
+					_, _ = c.Write([]byte{1, 1})
+					return
+				}
+				_, _ = c.Write([]byte{1, 0})
+				// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+				if _, err := io.ReadFull(c, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					_, _ = io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					_, _ = io.ReadFull(c, buf[:1])
+					n := int(buf[0])
+					_, _ = io.ReadFull(c, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				_, _ = io.ReadFull(c, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				remote, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					_, _ = c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer remote.Close()
+				_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() { _, _ = io.Copy(remote, c) }()
+				_, _ = io.Copy(c, remote)
+			}(c)
+		}
+	}()
+	return l
+}
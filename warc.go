@@ -0,0 +1,398 @@
+package goribot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotArchived = errors.New("request is not archived in WARC files")
+
+// WarcRecord is a record of WARC file
+type WarcRecord struct {
+	Header  textproto.MIMEHeader
+	Content []byte
+}
+
+// Type returns the WARC-Type of record
+func (r *WarcRecord) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+func newWarcRecord(typ, uri, contentType string, content []byte) *WarcRecord {
+	h := textproto.MIMEHeader{}
+	h.Set("WARC-Type", typ)
+	h.Set("WARC-Record-ID", "<urn:uuid:"+newUUID()+">")
+	h.Set("WARC-Date", time.Now().UTC().Format(time.RFC3339))
+	if uri != "" {
+		h.Set("WARC-Target-URI", uri)
+	}
+	h.Set("Content-Type", contentType)
+	return &WarcRecord{Header: h, Content: content}
+}
+
+// warcFields are the names of WARC fields written in order
+var warcFields = []string{
+	"WARC-Type", "WARC-Record-ID", "WARC-Date", "WARC-Target-URI", "WARC-Filename",
+	"WARC-Concurrent-To", "WARC-Refers-To", "Content-Type", "Content-Length",
+}
+
+// writeTo writes the record as a gzip member to w
+func (r *WarcRecord) writeTo(w io.Writer) error {
+	r.Header.Set("Content-Length", strconv.Itoa(len(r.Content)))
+	gz := gzip.NewWriter(w)
+	b := bufio.NewWriter(gz)
+	b.WriteString("WARC/1.0\r\n")
+	written := map[string]bool{}
+	for _, k := range warcFields {
+		written[textproto.CanonicalMIMEHeaderKey(k)] = true
+		for _, v := range r.Header[textproto.CanonicalMIMEHeaderKey(k)] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range r.Header[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(r.Content)
+	b.WriteString("\r\n\r\n")
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// newUUID returns a random UUID
+func newUUID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// WarcWriter writes responses as WARC records to gzip compressed files in a directory.
+// A new file is created when the current one is larger than MaxSize.
+type WarcWriter struct {
+	// MaxSize is the size of a WARC file to rotate, zero means no limit
+	MaxSize      int64
+	dir          string
+	lock         sync.Mutex
+	f            *os.File
+	size         int64
+	serial       int
+	openedPrefix string
+}
+
+// NewWarcWriter creates a WarcWriter writes files named like prefix-20060102150405-00000.warc.gz in dir
+func NewWarcWriter(dir, prefix string, maxSize int64) (*WarcWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &WarcWriter{
+		MaxSize:      maxSize,
+		dir:          dir,
+		openedPrefix: prefix + "-" + time.Now().UTC().Format("20060102150405"),
+	}, nil
+}
+
+// rotate opens a new file if there is no opened file or the opened one is too large
+func (w *WarcWriter) rotate() error {
+	if w.f != nil && (w.MaxSize <= 0 || w.size < w.MaxSize) {
+		return nil
+	}
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+		w.f = nil
+	}
+	name := fmt.Sprintf("%s-%05d.warc.gz", w.openedPrefix, w.serial)
+	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.f, w.size = f, 0
+	w.serial += 1
+	info := newWarcRecord("warcinfo", "", "application/warc-fields",
+		[]byte("software: goribot\r\nformat: WARC File Format 1.0\r\n"))
+	info.Header.Set("WARC-Filename", name)
+	return w.writeRecords(info)
+}
+
+func (w *WarcWriter) writeRecords(records ...*WarcRecord) error {
+	buf := &bytes.Buffer{}
+	for _, r := range records {
+		if err := r.writeTo(buf); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(buf.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+// WriteResponse writes the request and response records of resp, and a metadata record for the meta data
+// of the request if it's not empty. reqBody is the body of request, because it's consumed after sending.
+func (w *WarcWriter) WriteResponse(resp *Response, reqBody []byte) error {
+	req := resp.Req
+	uri := req.URL.String()
+
+	respBlock := &bytes.Buffer{}
+	fmt.Fprintf(respBlock, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	h := resp.Header.Clone()
+	// the body has been uncompressed and dechunked
+	h.Del("Content-Encoding")
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(resp.RawBody)))
+	_ = h.Write(respBlock)
+	respBlock.WriteString("\r\n")
+	respBlock.Write(resp.RawBody)
+	response := newWarcRecord("response", uri, "application/http; msgtype=response", respBlock.Bytes())
+	id := response.Header.Get("WARC-Record-ID")
+
+	reqBlock := &bytes.Buffer{}
+	fmt.Fprintf(reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	_ = req.Header.Write(reqBlock)
+	reqBlock.WriteString("\r\n")
+	reqBlock.Write(reqBody)
+	request := newWarcRecord("request", uri, "application/http; msgtype=request", reqBlock.Bytes())
+	request.Header.Set("WARC-Concurrent-To", id)
+
+	records := []*WarcRecord{response, request}
+	if len(req.Meta) > 0 {
+		meta := make(map[string]interface{}, len(req.Meta))
+		for k, v := range req.Meta {
+			if _, err := json.Marshal(v); err == nil {
+				meta[k] = v
+			} else {
+				meta[k] = fmt.Sprint(v)
+			}
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		metadata := newWarcRecord("metadata", uri, "application/json", data)
+		metadata.Header.Set("WARC-Refers-To", id)
+		records = append(records, metadata)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	return w.writeRecords(records...)
+}
+
+// Close closes the opened file
+func (w *WarcWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// SaveWarc is an extension archives every response with its request and meta data to rotating
+// gzip compressed WARC files in dir. The body is saved before character decoding.
+// Streaming responses are not archived.
+func SaveWarc(dir, prefix string, maxSize int64) func(s *Spider) {
+	w, err := NewWarcWriter(dir, prefix, maxSize)
+	if err != nil {
+		panic(err)
+	}
+	return func(s *Spider) {
+		s.Downloader.AddMiddleware(func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error) {
+			if req.Err != nil {
+				return next(req)
+			}
+			reqBody := req.GetBody()
+			resp, err = next(req)
+			if err == nil && resp != nil && resp.BodyReader == nil {
+				if err := w.WriteResponse(resp, reqBody); err != nil {
+					Log.Error("write WARC error", err)
+				}
+			}
+			return resp, err
+		})
+		s.OnFinish(func(s *Spider) {
+			if err := w.Close(); err != nil {
+				Log.Error(err)
+			}
+		})
+	}
+}
+
+// WarcReader reads records from a WARC file, which could be gzip compressed
+type WarcReader struct {
+	r *bufio.Reader
+}
+
+func NewWarcReader(r io.Reader) (*WarcReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	return &WarcReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF if there is no more record
+func (r *WarcReader) Next() (*WarcRecord, error) {
+	tp := textproto.NewReader(r.r)
+	var version string
+	for version == "" { // skip the blank lines between records
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC record version %q", version)
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WARC record Content-Length: %w", err)
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r.r, content); err != nil {
+		return nil, err
+	}
+	return &WarcRecord{Header: h, Content: content}, nil
+}
+
+// WarcDownloader is a Downloader serves the responses archived in WARC files instead of network,
+// so the saved pages could be parsed again.
+// The responses of the same URL are served in order and the last one is repeated.
+type WarcDownloader struct {
+	lock      sync.Mutex
+	responses map[string][]*WarcRecord
+	served    map[string]int
+	handlers  []func(req *Request, next func(req *Request) (resp *Response, err error)) (resp *Response, err error)
+}
+
+// NewWarcDownloader creates a WarcDownloader with the response records in WARC files
+func NewWarcDownloader(files ...string) (*WarcDownloader, error) {
+	d := &WarcDownloader{
+		responses: map[string][]*WarcRecord{},
+		served:    map[string]int{},
+	}
+	for _, name := range files {
+		if err := d.load(name); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (s *WarcDownloader) load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := NewWarcReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		if record.Type() == "response" {
+			uri := record.Header.Get("WARC-Target-URI")
+			s.responses[uri] = append(s.responses[uri], record)
+		}
+	}
+}
+
+func (s *WarcDownloader) AddMiddleware(fn func(req *Request, next func(*Request) (*Response, error)) (*Response, error)) {
+	s.handlers = append(s.handlers, fn)
+}
+
+func (s *WarcDownloader) defaultHandler(req *Request) (resp *Response, err error) {
+	if req.Err != nil {
+		return nil, DownloaderErr{req.Err, req, nil}
+	}
+	uri := req.URL.String()
+	s.lock.Lock()
+	records := s.responses[uri]
+	var record *WarcRecord
+	if len(records) > 0 {
+		i := s.served[uri]
+		if i >= len(records) {
+			i = len(records) - 1
+		}
+		s.served[uri] += 1
+		record = records[i]
+	}
+	s.lock.Unlock()
+	if record == nil {
+		return nil, DownloaderErr{fmt.Errorf("%w: %s", ErrNotArchived, uri), req, nil}
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(record.Content)), req.Request)
+	if err != nil {
+		return nil, DownloaderErr{err, req, nil}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, DownloaderErr{err, req, nil}
+	}
+	return newResponse(req, res.StatusCode, res.Header, body), nil
+}
+
+func (s *WarcDownloader) nextHandler(i int) func(req *Request) (resp *Response, err error) {
+	if i == -1 {
+		return s.defaultHandler
+	}
+	return func(req *Request) (resp *Response, err error) {
+		return s.handlers[i](req, s.nextHandler(i-1))
+	}
+}
+
+func (s *WarcDownloader) Do(req *Request) (resp *Response, err error) {
+	return s.nextHandler(len(s.handlers) - 1)(req)
+}
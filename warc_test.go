@@ -0,0 +1,114 @@
+package goribot
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWarc(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = fmt.Fprintf(gz, "<html><body><p>gzip</p></body></html>")
+			_ = gz.Close()
+			return
+		}
+		_, _ = fmt.Fprintf(w, "<html><body><p>%s</p></body></html>", r.URL.Path)
+	}))
+	dir, err := ioutil.TempDir("", "goribot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{"/a", "/b", "/gzip"}
+	s := NewSpider(SaveWarc(dir, "test", 1))
+	for _, p := range paths {
+		s.AddTask(GetReq(ts.URL+p).WithMeta("path", p), func(ctx *Context) {
+			if ctx.Resp.Dom.Find("p").Text() == "" {
+				t.Error("wrong response", ctx.Resp.Text)
+			}
+		})
+	}
+	s.Run()
+	ts.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "test-*.warc.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Error("WARC files are not rotated", files)
+	}
+	types := map[string]int{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewWarcReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			record, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			types[record.Type()] += 1
+			content := string(record.Content)
+			switch record.Type() {
+			case "response":
+				if strings.Contains(content, "Content-Encoding") || !strings.HasSuffix(content, "</p></body></html>") {
+					t.Error("wrong response record", content)
+				}
+			case "request":
+				if !strings.HasPrefix(content, "GET /") || record.Header.Get("WARC-Concurrent-To") == "" {
+					t.Error("wrong request record", content)
+				}
+			case "metadata":
+				if !strings.HasPrefix(content, `{"path":"/`) || record.Header.Get("WARC-Refers-To") == "" {
+					t.Error("wrong metadata record", content)
+				}
+			}
+		}
+		_ = f.Close()
+	}
+	if types["warcinfo"] != 3 || types["response"] != 3 || types["request"] != 3 || types["metadata"] != 3 {
+		t.Error("wrong records", types)
+	}
+
+	d, err := NewWarcDownloader(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	s = NewSpider()
+	s.Downloader = d
+	s.SetTaskPoolSize(1)
+	for _, p := range paths {
+		s.AddTask(GetReq(ts.URL+p), func(ctx *Context) {
+			got = append(got, ctx.Resp.Dom.Find("p").Text())
+		})
+	}
+	s.Run()
+	if fmt.Sprint(got) != "[/a /b gzip]" {
+		t.Error("wrong responses from WARC", got)
+	}
+	if _, err := d.Do(GetReq(ts.URL + "/c")); !errors.Is(err, ErrNotArchived) {
+		t.Error("wrong error of request not archived", err)
+	}
+}
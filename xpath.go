@@ -0,0 +1,337 @@
+package goribot
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"strconv"
+	"strings"
+)
+
+// xpathStep is a location step like "//div[@id='main']"
+type xpathStep struct {
+	descendant bool
+	name       string
+	preds      []xpathPred
+}
+
+// xpathPred reports whether the node at pos of size candidates matches the predicate
+type xpathPred func(n *html.Node, pos, size int) bool
+
+// XPath is a compiled expression of the subset of XPath used to select html elements.
+// It supports absolute location paths of child ("/") and descendant ("//") steps with element names or "*",
+// and predicates of position ("[1]", "[last()]"), attribute or text ("[@href]", "[@id='main']", "[text()='next']"),
+// functions "contains" and "starts-with" ("[contains(@class,'item')]") and "and".
+// "text()" is the text of the direct child text nodes and "." is the text of all descendants.
+// "[@attr]" and "[text()]" test whether the attribute or text node exists, even if it's empty.
+//
+// It doesn't support "or", "not()", relative paths, paths in predicates, axes like "parent::" or "..",
+// selecting attributes or text like "//a/@href", other functions or comparing numbers,
+// and CompileXPath fails with them.
+type XPath struct {
+	expr  string
+	steps []xpathStep
+}
+
+// CompileXPath parses the expression
+func CompileXPath(expr string) (*XPath, error) {
+	x := &XPath{expr: expr}
+	rest := strings.TrimSpace(expr)
+	if !strings.HasPrefix(rest, "/") {
+		return nil, fmt.Errorf("xpath %q: only absolute location paths are supported", expr)
+	}
+	for rest != "" {
+		st := xpathStep{}
+		if strings.HasPrefix(rest, "//") {
+			st.descendant, rest = true, rest[2:]
+		} else if strings.HasPrefix(rest, "/") {
+			rest = rest[1:]
+		} else {
+			return nil, fmt.Errorf("xpath %q: unexpected %q", expr, rest)
+		}
+		i := strings.IndexAny(rest, "/[")
+		if i < 0 {
+			i = len(rest)
+		}
+		st.name, rest = strings.ToLower(strings.TrimSpace(rest[:i])), rest[i:]
+		if st.name == "" || strings.ContainsAny(st.name, "()@:=. ") {
+			return nil, fmt.Errorf("xpath %q: unsupported step %q", expr, st.name)
+		}
+		for strings.HasPrefix(rest, "[") {
+			end := xpathClosing(rest)
+			if end < 0 {
+				return nil, fmt.Errorf("xpath %q: unclosed predicate", expr)
+			}
+			p, err := compileXPathPred(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("xpath %q: %w", expr, err)
+			}
+			st.preds, rest = append(st.preds, p), rest[end+1:]
+		}
+		x.steps = append(x.steps, st)
+	}
+	return x, nil
+}
+
+// MustCompileXPath is like CompileXPath but panics if the expression is invalid
+func MustCompileXPath(expr string) *XPath {
+	x, err := CompileXPath(expr)
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
+
+func (x *XPath) String() string {
+	return x.expr
+}
+
+// Select returns the elements selected from root in document order
+func (x *XPath) Select(root *html.Node) []*html.Node {
+	nodes := []*html.Node{root}
+	for _, st := range x.steps {
+		var parents []*html.Node
+		if st.descendant {
+			seen := map[*html.Node]struct{}{}
+			for _, n := range nodes {
+				xpathWalk(n, func(d *html.Node) {
+					if _, ok := seen[d]; !ok {
+						seen[d] = struct{}{}
+						parents = append(parents, d)
+					}
+				})
+			}
+		} else {
+			parents = nodes
+		}
+		var res []*html.Node
+		seen := map[*html.Node]struct{}{}
+		for _, p := range parents {
+			var candidates []*html.Node
+			for c := p.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.ElementNode && (st.name == "*" || c.Data == st.name) {
+					candidates = append(candidates, c)
+				}
+			}
+			for _, pred := range st.preds {
+				var kept []*html.Node
+				for i, c := range candidates {
+					if pred(c, i+1, len(candidates)) {
+						kept = append(kept, c)
+					}
+				}
+				candidates = kept
+			}
+			for _, c := range candidates {
+				if _, ok := seen[c]; !ok {
+					seen[c] = struct{}{}
+					res = append(res, c)
+				}
+			}
+		}
+		nodes = res
+	}
+	return nodes
+}
+
+// xpathWalk calls fn with n and its descendants in document order
+func xpathWalk(n *html.Node, fn func(n *html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		xpathWalk(c, fn)
+	}
+}
+
+// xpathClosing returns the index of "]" closing the "[" at the start of s, skipping the quoted strings
+func xpathClosing(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth += 1
+		case c == ']':
+			depth -= 1
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// xpathSplit splits the expression by the operator like " and " outside the quoted strings
+func xpathSplit(s, op string) []string {
+	var res []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '\'' || c == '"' {
+			quote = c
+		} else if strings.HasPrefix(s[i:], op) {
+			res = append(res, s[start:i])
+			start = i + len(op)
+			i += len(op) - 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+func compileXPathPred(expr string) (xpathPred, error) {
+	if len(xpathSplit(expr, " or ")) > 1 {
+		return nil, fmt.Errorf("unsupported operator \"or\" in %q", expr)
+	}
+	if parts := xpathSplit(expr, " and "); len(parts) > 1 {
+		var preds []xpathPred
+		for _, part := range parts {
+			p, err := compileXPathPred(part)
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, p)
+		}
+		return func(n *html.Node, pos, size int) bool {
+			for _, p := range preds {
+				if !p(n, pos, size) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+
+	expr = strings.TrimSpace(expr)
+	if i, err := strconv.Atoi(expr); err == nil {
+		return func(n *html.Node, pos, size int) bool { return pos == i }, nil
+	}
+	if expr == "last()" {
+		return func(n *html.Node, pos, size int) bool { return pos == size }, nil
+	}
+	for _, fn := range []string{"contains", "starts-with"} {
+		if !strings.HasPrefix(expr, fn+"(") || !strings.HasSuffix(expr, ")") {
+			continue
+		}
+		args := xpathSplit(expr[len(fn)+1:len(expr)-1], ",")
+		if len(args) != 2 {
+			return nil, fmt.Errorf("bad function %q", expr)
+		}
+		value, err := compileXPathArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		arg, err := compileXPathArg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		match := strings.Contains
+		if fn == "starts-with" {
+			match = strings.HasPrefix
+		}
+		return func(n *html.Node, pos, size int) bool {
+			v, ok := value(n)
+			a, aok := arg(n)
+			return ok && aok && match(v, a)
+		}, nil
+	}
+	if i := strings.Index(expr, "="); i > 0 {
+		not := expr[i-1] == '!'
+		left := expr[:i]
+		if not {
+			left = expr[:i-1]
+		}
+		value, err := compileXPathOperand(left)
+		if err != nil {
+			return nil, err
+		}
+		lit, err := xpathLiteral(expr[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(n *html.Node, pos, size int) bool {
+			v, ok := value(n)
+			return ok && (v == lit) != not
+		}, nil
+	}
+	value, err := compileXPathOperand(expr)
+	if err != nil {
+		return nil, err
+	}
+	// like a node-set, it's true if the attribute or text node exists even if it's empty
+	return func(n *html.Node, pos, size int) bool {
+		_, ok := value(n)
+		return ok
+	}, nil
+}
+
+// compileXPathArg compiles a function argument of string literal or operand
+func compileXPathArg(s string) (func(n *html.Node) (string, bool), error) {
+	if s = strings.TrimSpace(s); s != "" && (s[0] == '\'' || s[0] == '"') {
+		lit, err := xpathLiteral(s)
+		if err != nil {
+			return nil, err
+		}
+		return func(n *html.Node) (string, bool) { return lit, true }, nil
+	}
+	return compileXPathOperand(s)
+}
+
+// compileXPathOperand compiles "@attr", "text()" or "." to a function returning the value of node
+func compileXPathOperand(s string) (func(n *html.Node) (string, bool), error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "@") && len(s) > 1:
+		name := strings.ToLower(s[1:])
+		return func(n *html.Node) (string, bool) {
+			for _, a := range n.Attr {
+				if a.Namespace == "" && a.Key == name {
+					return a.Val, true
+				}
+			}
+			return "", false
+		}, nil
+	case s == "text()":
+		// the direct child text nodes, it's their joined text instead of a node-set here
+		return func(n *html.Node) (string, bool) {
+			var b strings.Builder
+			ok := false
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					b.WriteString(c.Data)
+					ok = true
+				}
+			}
+			return b.String(), ok
+		}, nil
+	case s == ".":
+		// the string value of node is the text of all descendants
+		return func(n *html.Node) (string, bool) {
+			var b strings.Builder
+			xpathWalk(n, func(d *html.Node) {
+				if d.Type == html.TextNode {
+					b.WriteString(d.Data)
+				}
+			})
+			return b.String(), true
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported predicate %q", s)
+}
+
+// xpathLiteral unquotes a string literal
+func xpathLiteral(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] && strings.IndexByte(s[1:len(s)-1], s[0]) < 0 {
+		return s[1 : len(s)-1], nil
+	}
+	return "", fmt.Errorf("bad string literal %q", s)
+}